@@ -1,6 +1,7 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"os"
 
@@ -8,12 +9,21 @@ import (
 )
 
 func main() {
-	s, err := os.ReadFile(os.Args[1])
+	noopt := flag.Bool("noopt", false, "disable the bytecode optimizer")
+	autosemi := flag.Bool("autosemi", false, "insert semicolons at line ends")
+	flag.Parse()
+	f, err := os.Open(flag.Arg(0))
 	if err != nil {
 		fmt.Println(err)
 		return
 	}
-	if err := glox.Interpret(string(s)); err != nil {
+	defer f.Close()
+	if err := glox.InterpretReader(f, glox.Options{
+		NoOptimize: *noopt,
+		AutoSemi:   *autosemi,
+		Path:       flag.Arg(0),
+		Warn:       func(d glox.Diagnostic) { fmt.Fprintln(os.Stderr, d) },
+	}); err != nil {
 		fmt.Println("ERROR: ", err.Error())
 	}
 }
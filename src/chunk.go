@@ -4,6 +4,7 @@ type OpCode byte
 
 const (
 	OP_CONST OpCode = iota
+	OP_CONST_LONG // constant with a 16 bit index
 
 	OP_TRUE
 	OP_FALSE
@@ -11,19 +12,18 @@ const (
 	OP_POP // pop top value of the stack and disregard it
 
 	OP_GET_LOCAL // read current local value and push it on the stack
-	OP_SET_LOCAL // writes to local-variable the top value on the stack
+	OP_SET_LOCAL // pops the top value on the stack into a local variable
 
 	OP_DEF_GLOBAL // define a global variable
 	OP_GET_GLOBAL // read current global val and push it on stack
-	OP_SET_GLOBAL // writes to existing global variable
-
-	OP_LOR // ||
-
-	OP_LAND // &&
+	OP_SET_GLOBAL // pops the top value on the stack into an existing global variable
 
 	OP_EQL // ==
+	OP_NEQ // !=
 	OP_GTR // >
+	OP_GEQ // >=
 	OP_LSS // <
+	OP_LEQ // <=
 
 	OP_ADD // +
 	OP_SUB // -
@@ -49,20 +49,42 @@ const (
 
 	OP_JUMP
 	OP_JUMP_IF_FALSE
+	OP_JUMP_IF_TRUE
 	OP_JUMP_BACK
     OP_CALL
     OP_NIL
+
+	OP_MATCH // push whether the top of the stack matches a constant pattern, leaves the value
+
+	OP_TRY     // install an exception handler, operand is the forward offset of the catch block
+	OP_END_TRY // remove the innermost exception handler
+	OP_THROW   // raise the value on top of the stack
+
+	OP_YIELD    // suspend the running coroutine, handing the top of the stack to its resumer
+	OP_FOR_ITER // take the next value of the coroutine or channel on top of the stack, jump forward by the operand once it is done
+
+	OP_SPAWN // start a task for the call of the function under the operand arguments
+	OP_CHAN  // make a channel, the capacity is on top of the stack
+	OP_SEND  // send the top of the stack on the channel below it
+	OP_RECV  // receive from the channel on top of the stack
+	OP_CLOSE // close the channel on top of the stack
+
+	OP_EPRINT // print expression to stderr
 )
 
 func (o OpCode) String() string {
 	strs := []string{
-		"OP_CONST ", "OP_TRUE ", "OP_FALSE ",
+		"OP_CONST ", "OP_CONST_LONG ", "OP_TRUE ", "OP_FALSE ",
 		"OP_POP ", "OP_GET_LOCAL", "OP_SET_LOCAL",
-		"OP_GET_GLOBAL ", "OP_DEF_GLOBAL ", "OP_SET_GLOBAL ",
-		"OP_LOR ", "OP_LAND ", "OP_EQL ", "OP_GTR ", "OP_LSS ",
+		"OP_DEF_GLOBAL ", "OP_GET_GLOBAL ", "OP_SET_GLOBAL ",
+		"OP_EQL ", "OP_NEQ ", "OP_GTR ", "OP_GEQ ", "OP_LSS ", "OP_LEQ ",
 		"OP_ADD ", "OP_SUB ", "OP_OR  ", "OP_XOR ", "OP_MULT ", "OP_DIV  ", "OP_MOD ", "OP_LSH ", "OP_RSH  ", "OP_AND ",
 		"OP_UNARY_NOT ", "OP_UNARY_ADD ", "OP_UNARY_SUB ", "OP_UNARY_TILDE ",
-		"OP_PRINT ", "OP_RETURN ", "OP_JUMP", "OP_JUMP_IF_FALSE", "OP_JUMP_BACK", "OP_CALL", "OP_NIL",
+		"OP_PRINT ", "OP_RETURN ", "OP_JUMP", "OP_JUMP_IF_FALSE", "OP_JUMP_IF_TRUE", "OP_JUMP_BACK", "OP_CALL", "OP_NIL",
+		"OP_MATCH", "OP_TRY", "OP_END_TRY", "OP_THROW",
+		"OP_YIELD", "OP_FOR_ITER",
+		"OP_SPAWN", "OP_CHAN", "OP_SEND", "OP_RECV", "OP_CLOSE",
+		"OP_EPRINT",
 	}
 	return strs[o]
 }
@@ -88,3 +110,13 @@ func (c *Chunk) AddConst(_const Value) int {
 	c.consts = append(c.consts, _const)
 	return ind
 }
+
+// add a constant that is loaded with OP_CONST_LONG
+func (c *Chunk) AddConstLong(_const Value) int {
+	ind := len(c.consts)
+	if ind >= UINT16_MAX {
+		panic("error: too many constants in one chunk")
+	}
+	c.consts = append(c.consts, _const)
+	return ind
+}
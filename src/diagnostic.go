@@ -0,0 +1,45 @@
+package glox
+
+import "fmt"
+
+type Severity int
+
+const (
+	ERROR Severity = iota
+	WARNING
+)
+
+func (s Severity) String() string {
+	if s == WARNING {
+		return "warning"
+	}
+	return "error"
+}
+
+// Diagnostic is a compile time error or warning at a position in the source
+type Diagnostic struct {
+	Severity Severity
+	File     string // imported module the position is in, empty for the main script
+	Pos      Position
+	Msg      string
+}
+
+func (d Diagnostic) Error() string {
+	pos := d.Pos.String()
+	if d.File != "" {
+		pos = d.File + ":" + pos
+	}
+	if d.Severity == WARNING {
+		return fmt.Sprintf("warning: %v:%v", d.Msg, pos)
+	}
+	return fmt.Sprintf("%v:%v", d.Msg, pos)
+}
+
+// Check compiles a script without running it and returns every error and
+// warning the compiler found
+func Check(input string, opts Options) []Diagnostic {
+	p := NewParser(input)
+	p.configure(opts)
+	p.compile()
+	return p.Diagnostics
+}
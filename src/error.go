@@ -0,0 +1,81 @@
+package glox
+
+import "fmt"
+
+// RuntimeError is an error raised while a script runs, try/catch can catch
+// it. Value is what the catch block receives: the thrown value, or the
+// error itself when the VM raised it
+type RuntimeError struct {
+	Msg   string
+	Line  int
+	Value Value
+}
+
+func runtimeError(lin int, format string, args ...any) *RuntimeError {
+	e := &RuntimeError{Msg: fmt.Sprintf(format, args...), Line: lin}
+	e.Value = ObjVal(e)
+	return e
+}
+
+func (e *RuntimeError) isObject() {}
+
+func (e *RuntimeError) Error() string { return fmt.Sprintf("%v:%v", e.Msg, e.Line) }
+
+func (e *RuntimeError) String() string { return e.Error() }
+
+// errors that stop a script at one of the limits in Options, try/catch
+// can't catch them
+
+// InstructionLimitError is returned when a run executes more than
+// Options.MaxInstructions instructions
+type InstructionLimitError struct {
+	Limit int64
+	Line  int
+}
+
+func (e *InstructionLimitError) Error() string {
+	return fmt.Sprintf("instruction limit of %v exceeded:%v", e.Limit, e.Line)
+}
+
+// CallDepthError is returned when calls nest deeper than Options.MaxCallDepth
+type CallDepthError struct {
+	Limit int
+	Line  int
+}
+
+func (e *CallDepthError) Error() string {
+	return fmt.Sprintf("call depth limit of %v exceeded:%v", e.Limit, e.Line)
+}
+
+// StackOverflowError is returned when a stack needs more than
+// Options.MaxStack values
+type StackOverflowError struct {
+	Limit int
+	Line  int
+}
+
+func (e *StackOverflowError) Error() string {
+	return fmt.Sprintf("stack limit of %v exceeded:%v", e.Limit, e.Line)
+}
+
+// CanceledError is returned when Options.Context is done before the script
+// ends, Err is the context's error
+type CanceledError struct {
+	Err  error
+	Line int
+}
+
+func (e *CanceledError) Error() string { return fmt.Sprintf("%v:%v", e.Err, e.Line) }
+
+func (e *CanceledError) Unwrap() error { return e.Err }
+
+// MemoryLimitError is returned when a script holds more than
+// Options.MaxMemory bytes
+type MemoryLimitError struct {
+	Limit int64
+	Line  int
+}
+
+func (e *MemoryLimitError) Error() string {
+	return fmt.Sprintf("memory limit of %v bytes exceeded:%v", e.Limit, e.Line)
+}
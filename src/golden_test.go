@@ -0,0 +1,113 @@
+package glox
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// annotations in the scripts under testdata. Each `// expect: out` is a line
+// the script prints, in order. `// expect compile error: msg` and
+// `// expect runtime error: msg` expect an error reported on their own line
+var expectRe = regexp.MustCompile(`// expect( compile error| runtime error)?: ?(.*)$`)
+
+type expectations struct {
+	out     []string
+	compile []string // "line: msg"
+	runtime string   // "msg:line", as RuntimeError prints
+}
+
+func parseExpectations(src string) expectations {
+	var e expectations
+	for i, line := range strings.Split(src, "\n") {
+		m := expectRe.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		switch m[1] {
+		case "":
+			e.out = append(e.out, m[2])
+		case " compile error":
+			e.compile = append(e.compile, fmt.Sprintf("%v: %v", i+1, m[2]))
+		case " runtime error":
+			e.runtime = fmt.Sprintf("%v:%v", m[2], i+1)
+		}
+	}
+	return e
+}
+
+func TestGolden(t *testing.T) {
+	var files []string
+	err := filepath.WalkDir("testdata", func(path string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() && filepath.Ext(path) == ".glox" {
+			files = append(files, path)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range files {
+		name := strings.TrimSuffix(filepath.ToSlash(strings.TrimPrefix(path, "testdata"+string(filepath.Separator))), ".glox")
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			src, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			runGolden(t, path, string(src))
+		})
+	}
+}
+
+func runGolden(t *testing.T, path, src string) {
+	want := parseExpectations(src)
+
+	var got []string
+	for _, d := range Check(src, Options{Path: path}) {
+		if d.Severity != ERROR {
+			continue
+		}
+		if d.File != "" {
+			got = append(got, fmt.Sprintf("%v:%v: %v", d.File, d.Pos.Line, d.Msg))
+		} else {
+			got = append(got, fmt.Sprintf("%v: %v", d.Pos.Line, d.Msg))
+		}
+	}
+	if len(want.compile) > 0 || len(got) > 0 {
+		if !slices.Equal(got, want.compile) {
+			t.Errorf("compile errors:\ngot  %q\nwant %q", got, want.compile)
+		}
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var out strings.Builder
+	opts := Options{Path: path, Stdout: &out, Stderr: io.Discard, Context: ctx}
+	prog, err := Compile(src, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = NewVMWithOptions(opts).Run(prog)
+	switch {
+	case err == nil && want.runtime != "":
+		t.Errorf("runtime error: got none, want %q", want.runtime)
+	case err != nil && err.Error() != want.runtime:
+		t.Errorf("runtime error: got %q, want %q", err, want.runtime)
+	}
+
+	lines := strings.Split(out.String(), "\n")
+	lines = lines[:len(lines)-1] // every print ends its line
+	if !slices.Equal(lines, want.out) {
+		t.Errorf("output:\ngot  %q\nwant %q", lines, want.out)
+	}
+}
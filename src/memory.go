@@ -0,0 +1,139 @@
+package glox
+
+import "unsafe"
+
+// bytes accounted for the objects a script allocates
+const (
+	VALUE_SIZE     = int64(unsafe.Sizeof(Value{}))
+	FRAME_SIZE     = int64(unsafe.Sizeof(CallFrame{}))
+	COROUTINE_SIZE = int64(unsafe.Sizeof(CoroutineObject{}))
+	TASK_SIZE      = int64(unsafe.Sizeof(task{}))
+	CHANNEL_SIZE   = int64(unsafe.Sizeof(ChannelObject{}))
+)
+
+const GC_MIN = 1 << 20 // bytes counted before the first collection
+
+// Stats describes the last run of a VM. Memory counts the stacks of the
+// main script, tasks and coroutines, and channels with their buffers. A
+// coroutine or task gives its memory back when it finishes, the channels
+// and coroutines nothing can reach anymore give theirs back at the next
+// collection. The VM collects once the count doubles or would cross
+// Options.MaxMemory, and when the run ends
+type Stats struct {
+	Instructions int64 // instructions executed
+	Memory       int64 // bytes held when the run ended
+	PeakMemory   int64 // most bytes counted at once, garbage counts until it is collected
+}
+
+func (vm *VM) Stats() Stats {
+	return Stats{
+		Instructions: vm.executed + vm.slice - vm.steps,
+		Memory:       vm.memory,
+		PeakMemory:   vm.peak_memory,
+	}
+}
+
+func (f *fiber) size() int64 {
+	return int64(len(f.stack))*VALUE_SIZE + int64(len(f.frames))*FRAME_SIZE
+}
+
+// account n more bytes, collecting once the count doubled or crossed the
+// limit. Still being over the limit stops the script at the next check
+func (vm *VM) alloc(n int64) {
+	vm.memory += n
+	if vm.memory > vm.next_gc || vm.max_memory > 0 && vm.memory > vm.max_memory {
+		vm.collect(n)
+		return
+	}
+	vm.peak_memory = max(vm.peak_memory, vm.memory)
+}
+
+func (vm *VM) free(n int64) {
+	vm.memory -= n
+}
+
+// recount the memory as the bytes reachable from the globals and the live
+// tasks, pending bytes belong to an object that isn't reachable yet
+func (vm *VM) collect(pending int64) {
+	m := marker{seen: map[any]bool{}, main: vm.main}
+	vm.current.fiber, vm.current.resumers = vm.fiber, vm.resumers
+	m.task(vm.current)
+	m.task(vm.main)
+	for _, t := range vm.ready {
+		m.task(t)
+	}
+	for _, v := range vm.globals {
+		m.value(v)
+	}
+	vm.memory = m.size + pending
+	vm.next_gc = max(2*vm.memory, GC_MIN)
+	vm.peak_memory = max(vm.peak_memory, vm.memory)
+	if vm.max_memory > 0 && vm.memory > vm.max_memory {
+		vm.stop()
+	}
+}
+
+// the objects a collection reached and their bytes
+type marker struct {
+	seen map[any]bool
+	main *task // its bytes are the VM's own
+	size int64
+}
+
+func (m *marker) task(t *task) {
+	if m.seen[t] {
+		return
+	}
+	m.seen[t] = true
+	if t != m.main {
+		m.size += TASK_SIZE
+	}
+	// a running coroutine's own fiber is stale, its stacks are the ones
+	// the task switched to last
+	for _, r := range t.resumers {
+		m.seen[r.co] = true
+		m.size += COROUTINE_SIZE
+	}
+	for _, r := range t.resumers {
+		m.fiber(r.fiber)
+	}
+	m.fiber(t.fiber)
+	m.value(t.inbox)
+}
+
+func (m *marker) fiber(f fiber) {
+	m.size += f.size()
+	for _, v := range f.stack[:f.sp] {
+		m.value(v)
+	}
+}
+
+func (m *marker) value(v Value) {
+	switch o := v.obj.(type) {
+	case *ChannelObject:
+		if m.seen[o] {
+			return
+		}
+		m.seen[o] = true
+		m.size += CHANNEL_SIZE + int64(o.cap)*VALUE_SIZE
+		for _, v := range o.buf {
+			m.value(v)
+		}
+		for _, r := range o.recvq {
+			m.task(r.t)
+		}
+		for _, s := range o.sendq {
+			m.task(s.t)
+			m.value(s.val)
+		}
+	case *CoroutineObject:
+		if m.seen[o] {
+			return
+		}
+		m.seen[o] = true
+		if !o.done { // a finished coroutine gave its bytes back
+			m.size += COROUTINE_SIZE
+			m.fiber(o.fiber)
+		}
+	}
+}
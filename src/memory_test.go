@@ -0,0 +1,126 @@
+package glox
+
+import (
+	"errors"
+	"testing"
+	"unsafe"
+)
+
+func run(t *testing.T, src string, opts Options) (Stats, error) {
+	t.Helper()
+	prog, err := Compile(src, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm := NewVMWithOptions(opts)
+	err = vm.Run(prog)
+	return vm.Stats(), err
+}
+
+func TestStats(t *testing.T) {
+	base, err := run(t, "let a = 1;", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if base.Memory == 0 || base.PeakMemory != base.Memory {
+		t.Errorf("empty script: %+v", base)
+	}
+
+	// the count is exact, a limit of that many instructions is just enough
+	stats, err := run(t, sumLoop, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := run(t, sumLoop, Options{MaxInstructions: stats.Instructions}); err != nil {
+		t.Errorf("limit of %v instructions: %v", stats.Instructions, err)
+	}
+	var steps *InstructionLimitError
+	if _, err := run(t, sumLoop, Options{MaxInstructions: stats.Instructions - 1}); !errors.As(err, &steps) {
+		t.Errorf("limit of %v instructions: got %v", stats.Instructions-1, err)
+	}
+
+	// finished coroutines and tasks give their stacks back
+	stats, err = run(t, `
+fn gen() { yield 1; }
+fn work(c) { send c, 1; }
+let c = chan();
+let i = 0;
+while i < 100 { for v in gen() {} spawn work(c); recv c; i += 1; }
+`, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Memory != base.Memory+CHANNEL_SIZE || stats.PeakMemory <= stats.Memory {
+		t.Errorf("finished coroutines and tasks: %+v, want memory %v", stats, base.Memory+CHANNEL_SIZE)
+	}
+
+	// so do channels and coroutines nothing can reach, and the tasks
+	// blocked forever on them
+	stats, err = run(t, `
+fn gen() { yield 1; }
+fn work(c, done) { send done, 1; recv c; }
+let done = chan();
+let i = 0;
+while i < 100 { let g = gen(); g(); spawn work(chan(10), done); recv done; i += 1; }
+`, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Memory != base.Memory+CHANNEL_SIZE {
+		t.Errorf("garbage: %+v, want memory %v", stats, base.Memory+CHANNEL_SIZE)
+	}
+
+	stats, err = run(t, "let c = chan(1000);", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := base.Memory + CHANNEL_SIZE + 1000*VALUE_SIZE; stats.Memory != want {
+		t.Errorf("buffered channel: %v bytes, want %v", stats.Memory, want)
+	}
+}
+
+func TestMemoryLimit(t *testing.T) {
+	tests := []string{
+		"let c = chan(1);\nwhile true { let d = chan(100); send d, c; c = d; }",
+		"fn gen(prev) { yield prev; }\nlet g = nil;\nwhile true { g = gen(g); }",
+		"fn f(n) { return f(n + 1); }\nf(0);",
+	}
+	for _, src := range tests {
+		var mem *MemoryLimitError
+		stats, err := run(t, src, Options{MaxMemory: 200_000, MaxCallDepth: 100_000})
+		if !errors.As(err, &mem) || mem.Limit != 200_000 {
+			t.Errorf("%q: got %v", src, err)
+		}
+		if stats.PeakMemory <= 200_000 {
+			t.Errorf("%q: peak of %v bytes is under the limit", src, stats.PeakMemory)
+		}
+	}
+
+	// garbage is collected before the limit is reached
+	tests = []string{
+		"while true { let c = chan(100); }",
+		"fn gen() { yield 1; }\nwhile true { let g = gen(); }",
+		"fn gen() { yield 1; }\nwhile true { let g = gen(); g(); }",
+	}
+	for _, src := range tests {
+		var steps *InstructionLimitError
+		stats, err := run(t, src, Options{MaxMemory: 200_000, MaxInstructions: 1_000_000})
+		if !errors.As(err, &steps) {
+			t.Errorf("%q: got %v", src, err)
+		}
+		if stats.PeakMemory > 200_000 {
+			t.Errorf("%q: peak of %v bytes is over the limit", src, stats.PeakMemory)
+		}
+	}
+}
+
+// a Value is four words, growing it makes every stack slot and channel
+// buffer bigger
+func TestValueSize(t *testing.T) {
+	if unsafe.Sizeof(uintptr(0)) != 8 {
+		t.Skip("not a 64-bit platform")
+	}
+	if VALUE_SIZE != 32 {
+		t.Errorf("Value is %v bytes, want 32", VALUE_SIZE)
+	}
+}
@@ -0,0 +1,138 @@
+package glox
+
+import (
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// a compiled script file, every module has a namespace of its own
+type module struct {
+	path   string
+	slots  map[string]int // top level name -> global slot
+	init   *FuntionObject // top level code of the module
+	called bool           // an import already emitted the call to init
+}
+
+// FSLoader loads imported modules from fsys, paths are slash separated and
+// relative to the root of fsys
+func FSLoader(fsys fs.FS) func(string) ([]byte, error) {
+	return func(name string) ([]byte, error) {
+		return fs.ReadFile(fsys, name)
+	}
+}
+
+func readFile(name string) ([]byte, error) {
+	return os.ReadFile(filepath.FromSlash(name))
+}
+
+// import "lib/math.glox" as m;
+// a module is compiled once, the first import that runs executes its top level code
+func (p *Parser) importStmt() {
+	import_token := p.consume(IMPORT)
+	spec := p.consume(STR_LIT)
+	if as := p.consume(IDENT); *as.Lit != "as" && !p.syntaxErr {
+		p.error(as.Start, "expected as, found %v", *as.Lit)
+		p.syntaxErr = true
+	}
+	alias := p.consume(IDENT)
+	p.consume(SEMI)
+	if p.syntaxErr {
+		return
+	}
+	if p.scopeDepth > 0 || !p.top_level {
+		p.error(import_token.Start, "import is only allowed at the top level")
+		return
+	}
+	if ind, ok := p.globalSlots[*alias.Lit]; p.imports[*alias.Lit] != nil || ok && p.globals[ind].defined {
+		p.error(alias.Start, "%v redeclared in this block", *alias.Lit)
+		return
+	}
+	mod := p.load(spec)
+	if mod == nil {
+		return
+	}
+	p.builtinDeclared(alias)
+	p.imports[*alias.Lit] = mod
+	if !mod.called {
+		mod.called = true
+		p.emitConst(ObjVal(mod.init))
+		p.emitByte(byte(OP_CALL), 0, byte(OP_POP))
+	}
+}
+
+// compile the module spec names, resolved against the importing file
+func (p *Parser) load(spec Token) *module {
+	name := *spec.Lit
+	if !path.IsAbs(name) {
+		name = path.Join(path.Dir(p.path), name)
+	}
+	for i, loading := range p.loading {
+		if loading == name {
+			cycle := append(append([]string{}, p.loading[i:]...), name)
+			p.error(spec.Start, "import cycle not allowed: %v", strings.Join(cycle, " -> "))
+			return nil
+		}
+	}
+	if mod, ok := p.modules[name]; ok {
+		return mod
+	}
+	src, err := p.loader(name)
+	if err != nil {
+		p.error(spec.Start, "can't import %v: %v", *spec.Lit, err)
+		return nil
+	}
+	mod := &module{path: name, slots: map[string]int{}}
+	for i, g := range p.globals {
+		if g.preset {
+			mod.slots[g.name] = i
+		}
+	}
+
+	// the module body is a function of its own, compiled by a fresh scanner
+	// and compiler into the module's namespace
+	scanner, compiler, slots, imports, builtins, file, terminated := p.Scanner, p.Compiler, p.globalSlots, p.imports, p.builtins, p.path, p.terminated
+	p.Scanner = NewScanner(string(src))
+	p.AutoSemi = p.autoSemi
+	p.Compiler = NewCompiler(nil, true)
+	p.function.name = &mod.path
+	p.globalSlots, p.imports, p.builtins, p.path = mod.slots, map[string]*module{}, map[string]Token{}, name
+	p.loading = append(p.loading, name)
+
+	p.declarations()
+	if !p.syntaxErr {
+		mod.init = p.endFunction()
+	}
+
+	p.loading = p.loading[:len(p.loading)-1]
+	failed := p.isPanic
+	p.Scanner, p.Compiler, p.globalSlots, p.imports, p.builtins, p.path, p.terminated = scanner, compiler, slots, imports, builtins, file, terminated
+	p.isPanic = p.isPanic || failed
+	if mod.init == nil {
+		return nil
+	}
+	p.modules[name] = mod
+	return mod
+}
+
+// m.name, a top level binding of an imported module, names starting with _ are private
+func (p *Parser) selector(alias Token, mod *module) {
+	if p.Peek(0).Kind != DOT {
+		p.error(alias.Start, "use of module %v without selector", *alias.Lit)
+		return
+	}
+	p.consume(DOT)
+	name := p.consume(IDENT)
+	slot, ok := mod.slots[*name.Lit]
+	switch {
+	case p.syntaxErr:
+	case !ok || !p.globals[slot].defined:
+		p.error(name.Start, "undefined: %v.%v", *alias.Lit, *name.Lit)
+	case strings.HasPrefix(*name.Lit, "_"):
+		p.error(name.Start, "%v.%v is not exported", *alias.Lit, *name.Lit)
+	default:
+		p.emitByte(byte(OP_GET_GLOBAL), byte(slot>>8), byte(slot&255))
+	}
+}
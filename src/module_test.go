@@ -0,0 +1,47 @@
+package glox
+
+import (
+	"testing"
+	"testing/fstest"
+)
+
+var modules = fstest.MapFS{
+	"lib/math.glox":   {Data: []byte(`import "util.glox" as u; let _n = 0; fn square(x) { _n += 1; return u.mul(x, x); }`)},
+	"lib/util.glox":   {Data: []byte(`fn mul(a, b) { return a * b; } let version = 2;`)},
+	"lib/a.glox":      {Data: []byte(`import "b.glox" as b;`)},
+	"lib/b.glox":      {Data: []byte(`import "a.glox" as a;`)},
+	"lib/broken.glox": {Data: []byte(`let x = 1`)},
+}
+
+func TestImport(t *testing.T) {
+	opts := Options{Path: "main.glox", Loader: FSLoader(modules)}
+	src := `
+import "lib/math.glox" as m;
+import "lib/util.glox" as u;
+let square = m.square(3);
+if square != 9 || u.version != 2 { throw "wrong"; }
+`
+	if err := InterpretWithOptions(src, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{`import "lib/a.glox" as a;`, "import cycle not allowed: lib/a.glox -> lib/b.glox -> lib/a.glox:lib/b.glox:1:8"},
+		{`import "lib/math.glox" as m; print m._n;`, "m._n is not exported:1:38"},
+		{`import "lib/math.glox" as m; print m.cube;`, "undefined: m.cube:1:38"},
+		{`import "lib/math.glox" as m; print m;`, "use of module m without selector:1:36"},
+		{`import "lib/math.glox" as m; let m = 1;`, "m redeclared in this block:1:34"},
+		{`import "nope.glox" as n;`, "can't import nope.glox: open nope.glox: file does not exist:1:8"},
+		{`import "lib/broken.glox" as b;`, "expected SEMI, found EOF:lib/broken.glox:1:10"},
+		{`fn f() { import "lib/util.glox" as u; }`, "import is only allowed at the top level:1:10"},
+	}
+	for _, tt := range tests {
+		got := Check(tt.src, opts)
+		if len(got) == 0 || got[0].Error() != tt.want {
+			t.Errorf("%q: got %v, want %q", tt.src, got, tt.want)
+		}
+	}
+}
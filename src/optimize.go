@@ -0,0 +1,312 @@
+package glox
+
+// peephole optimizer, runs over a finished chunk
+//   - folds constant unary and binary expressions
+//   - fuses `OP_EQL OP_UNARY_NOT` into OP_NEQ, `OP_GTR OP_UNARY_NOT` is left
+//     alone, it isn't OP_LEQ when an operand is NaN
+//   - threads jumps whose target is an unconditional jump or the same conditional jump
+//   - drops jumps to the very next instruction
+// OP_TRY and OP_FOR_ITER are treated as jumps to their catch block and loop exit
+
+type instr struct {
+	op     OpCode
+	arg    int // operand of non jump instructions
+	target int // instruction index, only for jumps
+	line   int
+	dead   bool
+}
+
+func isJump(op OpCode) bool {
+	switch op {
+	case OP_JUMP, OP_JUMP_IF_FALSE, OP_JUMP_IF_TRUE, OP_JUMP_BACK, OP_TRY, OP_FOR_ITER:
+		return true
+	}
+	return false
+}
+
+// a jump that doesn't change the stack and only depends on the value on top of it
+func isCondJump(op OpCode) bool {
+	return op == OP_JUMP_IF_FALSE || op == OP_JUMP_IF_TRUE
+}
+
+func operandSize(op OpCode) int {
+	switch op {
+	case OP_CONST, OP_GET_LOCAL, OP_SET_LOCAL, OP_PRINT, OP_EPRINT, OP_CALL, OP_MATCH, OP_SPAWN:
+		return 1
+	case OP_CONST_LONG, OP_DEF_GLOBAL, OP_GET_GLOBAL, OP_SET_GLOBAL:
+		return 2
+	case OP_JUMP, OP_JUMP_IF_FALSE, OP_JUMP_IF_TRUE, OP_JUMP_BACK, OP_TRY, OP_FOR_ITER:
+		return 2
+	}
+	return 0
+}
+
+func usesConst(op OpCode) bool {
+	switch op {
+	case OP_CONST, OP_CONST_LONG, OP_MATCH:
+		return true
+	}
+	return false
+}
+
+// decode bytecode into instructions, jump operands become instruction indices
+func decode(c *Chunk) []instr {
+	code := []instr{}
+	index := make([]int, len(c.bytecode)+1) // byte offset -> instruction index
+	offsets := []int{}
+	for off := 0; off < len(c.bytecode); {
+		op := OpCode(c.bytecode[off])
+		in := instr{op: op, line: c.lines[off]}
+		index[off] = len(code)
+		offsets = append(offsets, off)
+		switch operandSize(op) {
+		case 1:
+			in.arg = int(c.bytecode[off+1])
+		case 2:
+			in.arg = int(c.bytecode[off+1])<<8 | int(c.bytecode[off+2])
+		}
+		off += 1 + operandSize(op)
+		code = append(code, in)
+	}
+	index[len(c.bytecode)] = len(code)
+	for i := range code {
+		if !isJump(code[i].op) {
+			continue
+		}
+		next := offsets[i] + 3
+		if code[i].op == OP_JUMP_BACK {
+			code[i].target = index[next-code[i].arg]
+		} else {
+			code[i].target = index[next+code[i].arg]
+		}
+	}
+	return code
+}
+
+// encode instructions back into the chunk, unused constants are dropped
+func encode(c *Chunk, code []instr) bool {
+	offsets := make([]int, len(code)+1)
+	off := 0
+	for i, in := range code {
+		offsets[i] = off
+		if !in.dead {
+			off += 1 + operandSize(in.op)
+		}
+	}
+	offsets[len(code)] = off
+
+	// OP_CONST operands come first so they keep fitting in one byte
+	consts := []Value{}
+	remap := map[int]int{}
+	for _, long := range []bool{false, true} {
+		for _, in := range code {
+			if _, ok := remap[in.arg]; !ok && !in.dead && usesConst(in.op) && long == (in.op == OP_CONST_LONG) {
+				remap[in.arg] = len(consts)
+				consts = append(consts, c.consts[in.arg])
+			}
+		}
+	}
+	bytecode := make([]byte, 0, off)
+	lines := make([]int, 0, off)
+	write := func(b byte, line int) {
+		bytecode = append(bytecode, b)
+		lines = append(lines, line)
+	}
+	for i, in := range code {
+		if in.dead {
+			continue
+		}
+		write(byte(in.op), in.line)
+		switch {
+		case usesConst(in.op):
+			ind := remap[in.arg]
+			if in.op == OP_CONST_LONG {
+				write(byte(ind>>8), in.line)
+			}
+			write(byte(ind), in.line)
+		case isJump(in.op):
+			next := offsets[i] + 3
+			jump := offsets[in.target] - next
+			if in.op == OP_JUMP_BACK {
+				jump = next - offsets[in.target]
+			}
+			if jump < 0 || jump > UINT16_MAX {
+				return false
+			}
+			write(byte(jump>>8), in.line)
+			write(byte(jump&255), in.line)
+		case operandSize(in.op) == 1:
+			write(byte(in.arg), in.line)
+		case operandSize(in.op) == 2:
+			write(byte(in.arg>>8), in.line)
+			write(byte(in.arg&255), in.line)
+		}
+	}
+	c.bytecode = bytecode
+	c.lines = lines
+	c.consts = consts
+	return true
+}
+
+// index of the next live instruction starting at i
+func nextLive(code []instr, i int) int {
+	for i < len(code) && code[i].dead {
+		i++
+	}
+	return i
+}
+
+// returns index of the n live instructions that come before i, or nil
+func prevLive(code []instr, i, n int) []int {
+	res := make([]int, n)
+	for n > 0 {
+		i--
+		for i >= 0 && code[i].dead {
+			i--
+		}
+		if i < 0 {
+			return nil
+		}
+		n--
+		res[n] = i
+	}
+	return res
+}
+
+func foldUnary(op OpCode, a Value) (Value, bool) {
+	switch op {
+	case OP_UNARY_ADD:
+		if a.IsInt() || a.IsFloat() {
+			return a, true
+		}
+	case OP_UNARY_SUB:
+		if a.IsInt() {
+			return IntVal(-a.AsInt()), true
+		}
+		if a.IsFloat() {
+			return FloatVal(-a.AsFloat()), true
+		}
+	case OP_UNARY_NOT:
+		if a.IsBool() {
+			return BoolVal(!a.AsBool()), true
+		}
+	case OP_UNARY_TILDE:
+		if a.IsInt() {
+			return IntVal(^a.AsInt()), true
+		}
+	}
+	return NilValue, false
+}
+
+func foldBinary(op OpCode, a, b Value) (Value, bool) {
+	// runtime errors are left to the runtime
+	res, err := binary(a, b, op)
+	return res, err == nil
+}
+
+func isBinary(op OpCode) bool {
+	switch op {
+	case OP_EQL, OP_NEQ, OP_GTR, OP_GEQ, OP_LSS, OP_LEQ, OP_ADD, OP_SUB, OP_OR, OP_XOR, OP_MULT, OP_DIV, OP_MOD, OP_LSH, OP_RSH, OP_AND:
+		return true
+	}
+	return false
+}
+
+func isUnary(op OpCode) bool {
+	switch op {
+	case OP_UNARY_NOT, OP_UNARY_ADD, OP_UNARY_SUB, OP_UNARY_TILDE:
+		return true
+	}
+	return false
+}
+
+// Optimize rewrites the chunk in place, it reports false if the rewritten chunk can't be encoded
+func (c *Chunk) Optimize() bool {
+	code := decode(c)
+	targeted := make([]bool, len(code)+1)
+	for _, in := range code {
+		if isJump(in.op) {
+			targeted[in.target] = true
+		}
+	}
+
+	fused := map[OpCode]OpCode{OP_EQL: OP_NEQ}
+	for changed := true; changed; {
+		changed = false
+		for i := range code {
+			in := code[i]
+			if in.dead || targeted[i] {
+				continue
+			}
+			if in.op == OP_UNARY_NOT {
+				if prev := prevLive(code, i, 1); prev != nil {
+					if op, ok := fused[code[prev[0]].op]; ok {
+						code[prev[0]].op = op
+						code[i].dead = true
+						changed = true
+						continue
+					}
+				}
+			}
+			if isUnary(in.op) {
+				prev := prevLive(code, i, 1)
+				if prev == nil || code[prev[0]].op != OP_CONST {
+					continue
+				}
+				if val, ok := foldUnary(in.op, c.consts[code[prev[0]].arg]); ok {
+					code[prev[0]].arg = len(c.consts)
+					c.consts = append(c.consts, val)
+					code[i].dead = true
+					changed = true
+				}
+			}
+			if isBinary(in.op) {
+				prev := prevLive(code, i, 2)
+				if prev == nil || targeted[prev[1]] || code[prev[0]].op != OP_CONST || code[prev[1]].op != OP_CONST {
+					continue
+				}
+				if val, ok := foldBinary(in.op, c.consts[code[prev[0]].arg], c.consts[code[prev[1]].arg]); ok {
+					code[prev[0]].arg = len(c.consts)
+					c.consts = append(c.consts, val)
+					code[prev[1]].dead = true
+					code[i].dead = true
+					changed = true
+				}
+			}
+		}
+	}
+
+	for i := range code {
+		if !isJump(code[i].op) {
+			continue
+		}
+		// follow chains of unconditional jumps, bounded in case of a cycle
+		target := nextLive(code, code[i].target)
+		for n := 0; n < len(code) && target < len(code); n++ {
+			// a conditional jump landing on the same conditional jump sees the same value
+			uncond := code[target].op == OP_JUMP || code[target].op == OP_JUMP_BACK
+			if !uncond && (code[target].op != code[i].op || !isCondJump(code[i].op)) {
+				break
+			}
+			next := nextLive(code, code[target].target)
+			if next == target {
+				break
+			}
+			target = next
+		}
+		if target < i && code[i].op != OP_JUMP && code[i].op != OP_JUMP_BACK {
+			target = nextLive(code, code[i].target) // conditional jumps only go forward
+		}
+		code[i].target = target
+		switch {
+		case code[i].op == OP_JUMP && target <= i:
+			code[i].op = OP_JUMP_BACK
+		case code[i].op == OP_JUMP_BACK && target > i:
+			code[i].op = OP_JUMP
+		}
+		if code[i].op == OP_JUMP && nextLive(code, i+1) == target {
+			code[i].dead = true
+		}
+	}
+	return encode(c, code)
+}
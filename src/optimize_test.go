@@ -0,0 +1,128 @@
+package glox
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// one line per instruction, constants by value and jumps by target index
+func disassemble(c *Chunk) []string {
+	var res []string
+	for _, in := range decode(c) {
+		s := strings.TrimSpace(in.op.String())
+		switch {
+		case usesConst(in.op):
+			s += fmt.Sprintf(" %v", c.consts[in.arg])
+		case isJump(in.op):
+			s += fmt.Sprintf(" ->%d", in.target)
+		case operandSize(in.op) > 0:
+			s += fmt.Sprintf(" %d", in.arg)
+		}
+		res = append(res, s)
+	}
+	return res
+}
+
+// run a script and return what it printed and its error
+func output(t *testing.T, src string, opts Options) (*Program, string) {
+	t.Helper()
+	prog, err := Compile(src, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out strings.Builder
+	opts.Stdout = &out
+	if err := NewVMWithOptions(opts).Run(prog); err != nil {
+		fmt.Fprintf(&out, "error: %v\n", err)
+	}
+	return prog, out.String()
+}
+
+func TestOptimize(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		code []string // of the optimized script
+		out  string
+	}{
+		{
+			"fold", "print 1_000 * 60;",
+			[]string{"OP_CONST 60000", "OP_PRINT 1", "OP_NIL", "OP_RETURN"},
+			"60000\n",
+		},
+		{
+			"fold nested", "print -(2 + 3) * 4, !true;",
+			[]string{"OP_CONST -20", "OP_CONST false", "OP_PRINT 2", "OP_NIL", "OP_RETURN"},
+			"-20 false\n",
+		},
+		{
+			"division by zero is not folded", "print 1 / 0;",
+			[]string{"OP_CONST 1", "OP_CONST 0", "OP_DIV", "OP_PRINT 1", "OP_NIL", "OP_RETURN"},
+			"error: integer divide by zero:1\n",
+		},
+		{
+			"fuse not equal", "let a = 1;\nprint a != 2, a <= 2;",
+			[]string{
+				"OP_CONST 1", "OP_DEF_GLOBAL 0",
+				"OP_GET_GLOBAL 0", "OP_CONST 2", "OP_NEQ",
+				"OP_GET_GLOBAL 0", "OP_CONST 2", "OP_LEQ",
+				"OP_PRINT 2", "OP_NIL", "OP_RETURN",
+			},
+			"true true\n",
+		},
+		{
+			// !(a > b) is not a <= b for NaN, the pair stays
+			"nan", "let nan = 0.0 / 0.0;\nprint nan <= 1.0, nan >= 1.0, !(nan > 1.0), nan != nan;",
+			[]string{
+				"OP_CONST NaN", "OP_DEF_GLOBAL 0",
+				"OP_GET_GLOBAL 0", "OP_CONST 1", "OP_LEQ",
+				"OP_GET_GLOBAL 0", "OP_CONST 1", "OP_GEQ",
+				"OP_GET_GLOBAL 0", "OP_CONST 1", "OP_GTR", "OP_UNARY_NOT",
+				"OP_GET_GLOBAL 0", "OP_GET_GLOBAL 0", "OP_NEQ",
+				"OP_PRINT 4", "OP_NIL", "OP_RETURN",
+			},
+			"false false true true\n",
+		},
+		{
+			// the jump over the else block lands on the loop's back jump
+			"loop", "let i = 0;\nwhile i < 3 {\n    i += 1;\n    if i == 2 { print \"two\"; } else { print i; }\n}",
+			[]string{
+				"OP_CONST 0", "OP_DEF_GLOBAL 0",
+				"OP_GET_GLOBAL 0", "OP_CONST 3", "OP_LSS", "OP_JUMP_IF_FALSE ->23", "OP_POP",
+				"OP_GET_GLOBAL 0", "OP_CONST 1", "OP_ADD", "OP_SET_GLOBAL 0",
+				"OP_GET_GLOBAL 0", "OP_CONST 2", "OP_EQL", "OP_JUMP_IF_FALSE ->19", "OP_POP",
+				"OP_CONST two", "OP_PRINT 1", "OP_JUMP_BACK ->2",
+				"OP_POP", "OP_GET_GLOBAL 0", "OP_PRINT 1", "OP_JUMP_BACK ->2",
+				"OP_POP", "OP_NIL", "OP_RETURN",
+			},
+			"1\ntwo\n3\n",
+		},
+		{
+			// a false a skips straight past the second test
+			"and chain", "let a = true;\nlet b = false;\nprint a && b && a;",
+			[]string{
+				"OP_CONST true", "OP_DEF_GLOBAL 0", "OP_CONST false", "OP_DEF_GLOBAL 1",
+				"OP_GET_GLOBAL 0", "OP_JUMP_IF_FALSE ->11", "OP_POP",
+				"OP_GET_GLOBAL 1", "OP_JUMP_IF_FALSE ->11", "OP_POP",
+				"OP_GET_GLOBAL 0", "OP_PRINT 1", "OP_NIL", "OP_RETURN",
+			},
+			"false\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prog, out := output(t, tt.src, Options{})
+			if code := disassemble(prog.script.chunk); !slices.Equal(code, tt.code) {
+				t.Errorf("optimized code:\ngot  %q\nwant %q", code, tt.code)
+			}
+			if out != tt.out {
+				t.Errorf("optimized output: got %q, want %q", out, tt.out)
+			}
+			if _, out := output(t, tt.src, Options{NoOptimize: true}); out != tt.out {
+				t.Errorf("unoptimized output: got %q, want %q", out, tt.out)
+			}
+		})
+	}
+}
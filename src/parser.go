@@ -1,7 +1,11 @@
 package glox
 
 import (
+	"fmt"
+	"io"
+	"sort"
 	"strconv"
+	"strings"
 )
 
 /*
@@ -11,6 +15,14 @@ ifStmt
 printStmt
 returnStmt
 whileStmt
+forStmt
+matchStmt
+tryStmt
+throwStmt
+importStmt
+spawnStmt
+sendStmt
+closeStmt
 blockStmt
 emptyStmt
 assignStmt
@@ -19,7 +31,7 @@ breakStmt
 --- declaration ---
 structDecl // TODO
 funcDecl
-varDecl
+varDecl // let or const
 statement
 
 
@@ -35,24 +47,103 @@ type Compiler struct {
 	function  *FuntionObject
 	top_level bool
 	//function.chunk   *Chunk
-	locals     []Local
-	scopeDepth int
-	loopDepth  int
-	breaks     []int
+	locals       []Local
+	scopeDepth   int
+	blocks       []int    // for each open block, len(Parser.globalRefs) when it started
+	initializing []string // names of the let declarations whose initializer is being compiled
+	loopDepth    int
+	breaks       []int // exits of the innermost loop
+	loopLocals   int   // len(locals) when the innermost loop started, break pops the rest
+	tries        int   // open try blocks
+	loopTries    int   // open try blocks when the innermost loop started
+	lastCall     int   // offset of the OP_CALL the last expression ends with, -1 if it isn't a call
 }
 
 type Parser struct {
 	*Scanner
 	*Compiler
+	optimize    bool // run the peephole optimizer over every finished chunk
+	globals     []Global
+	globalSlots map[string]int // global name -> index in globals
+	globalRefs  []globalRef
+	err         error        // first compile error
+	Diagnostics []Diagnostic // errors and warnings in source order
+	terminated  bool         // last statement was a return or break
+	syntaxErr   bool         // stop compiling, later errors would only be noise
+
+	path     string             // of the file being compiled, imports are relative to it
+	imports  map[string]*module // module aliases of the file being compiled
+	builtins map[string]Token   // contextual names the file used as builtins, by first use
+	modules  map[string]*module // compiled modules by path
+	loading  []string           // files being compiled, the main script first
+	loader   func(string) ([]byte, error)
+	autoSemi bool // Options.AutoSemi, imported files get it too
+}
+
+// Global is a top level binding, resolved to a slot index at compile time
+type Global struct {
+	name     string
+	defined  bool // a top level let or fn declares it somewhere in the script
+	readonly bool // declared with const or installed by the embedder
+	preset   bool // installed by the embedder, value is set before the script runs
+	value    Value
 }
 
 type Local struct {
-	name  Token
-	depth int
+	name     Token
+	depth    int
+	fn       *FuntionObject // set for `fn name() {}` declared in a block, read only
+	used     bool
+	param    bool
+	readonly bool // declared with const
+}
+
+type varKind int
+
+const (
+	GLOBAL_VAR varKind = iota
+	LOCAL_VAR
+	FUNC_VAR // local function seen from a nested function, loaded as a constant
+)
+
+type varRef struct {
+	kind    varKind
+	ind     int // global slot, local slot or constant index
+	name    Token
+	invalid bool // already reported, don't check it again
+}
+
+// a compiled OP_GET_GLOBAL/OP_SET_GLOBAL, kept so a local function declared
+// later in the same block can take it over
+type globalRef struct {
+	slot     int
+	pos      Position
+	compiler *Compiler
+	offset   int  // of the instruction in compiler's chunk
+	hoisted  bool // rewritten to load a local function
+	set      bool // an assignment
 }
 
 func NewParser(input string) *Parser {
-	return &Parser{Scanner: NewScanner(input), Compiler: NewCompiler(nil, true)}
+	return newParser(NewScanner(input))
+}
+
+// NewReaderParser compiles source streamed from r
+func NewReaderParser(r io.Reader) *Parser {
+	return newParser(NewReaderScanner(r))
+}
+
+func newParser(sc *Scanner) *Parser {
+	return &Parser{
+		Scanner:     sc,
+		Compiler:    NewCompiler(nil, true),
+		optimize:    true,
+		globalSlots: map[string]int{},
+		builtins:    map[string]Token{},
+		imports:     map[string]*module{},
+		modules:     map[string]*module{},
+		loader:      readFile,
+	}
 }
 
 func NewCompiler(enclosing *Compiler, top_level bool) *Compiler {
@@ -65,17 +156,103 @@ func NewCompiler(enclosing *Compiler, top_level bool) *Compiler {
 	}
 }
 
+// record a compile error, the first one is what compiling fails with
+func (p *Parser) error(pos Position, format string, args ...any) {
+	p.isPanic = true
+	d := Diagnostic{Severity: ERROR, File: p.file(), Pos: pos, Msg: fmt.Sprintf(format, args...)}
+	p.Diagnostics = append(p.Diagnostics, d)
+	if p.err == nil {
+		p.err = d
+	}
+}
+
+func (p *Parser) warn(pos Position, format string, args ...any) {
+	if p.syntaxErr {
+		return
+	}
+	p.Diagnostics = append(p.Diagnostics, Diagnostic{Severity: WARNING, File: p.file(), Pos: pos, Msg: fmt.Sprintf(format, args...)})
+}
+
+// name of the imported module being compiled, empty for the main script
+func (p *Parser) file() string {
+	if len(p.loading) <= 1 {
+		return ""
+	}
+	return p.path
+}
+
+// report the scanner's message for an ILLEGAL token
+func (p *Parser) illegal(t Token) {
+	if t.Lit != nil {
+		p.error(t.Start, "%v", *t.Lit)
+	} else {
+		p.error(t.Start, "illegal character")
+	}
+}
+
+func (p *Parser) numberError(t Token, err error) {
+	if err.(*strconv.NumError).Err == strconv.ErrRange {
+		p.error(t.Start, "number literal %v out of range", *t.Lit)
+	} else {
+		p.error(t.Start, "invalid number literal %v", *t.Lit)
+	}
+}
+
+// value of an INT_LIT or FLOAT_LIT token
+func (p *Parser) number(t Token) (Value, bool) {
+	if t.Kind == FLOAT_LIT {
+		fval, err := strconv.ParseFloat(*t.Lit, 64)
+		if err != nil {
+			p.numberError(t, err)
+			return NilValue, false
+		}
+		return FloatVal(fval), true
+	}
+	base := 10
+	if len(*t.Lit) > 1 && !isDigit((*t.Lit)[1]) {
+		base = 0 // 0x 0o 0b prefix
+	}
+	ival, err := strconv.ParseInt(*t.Lit, base, 64)
+	if err != nil {
+		p.numberError(t, err)
+		return NilValue, false
+	}
+	return IntVal(ival), true
+}
+
+// the next token ends a statement. Like in Go, automatic semicolons let a
+// statement end right before the } of its block, so one-line blocks need no ;
+func (p *Parser) stmtEnd() bool {
+	t := p.Peek(0)
+	return t.Kind == SEMI || t.Kind == RBRACE && p.AutoSemi
+}
+
 func (p *Parser) consume(kind TokenKind) Token {
+	if kind == SEMI && p.stmtEnd() && p.Peek(0).Kind == RBRACE {
+		t := p.Peek(0)
+		return Token{Kind: SEMI, Line: t.Line, Start: t.Start, End: t.Start} // left for the block
+	}
 	t := p.Next()
+	switch {
+	case p.syntaxErr: // already reported, the rest of the statement is noise
+	case t.Kind == ILLEGAL:
+		p.illegal(t)
+	case t.Kind != kind:
+		p.error(t.Start, "expected %v, found %v", kind, t.Kind)
+	}
 	if t.Kind != kind {
-		p.isPanic = true
+		p.syntaxErr = true
+		if t.Lit == nil { // callers may use the literal of the token they expected
+			empty := ""
+			t.Lit = &empty
+		}
 	}
 	return t
 }
 
 func (p *Parser) emitByte(bs ...byte) {
 	for _, b := range bs {
-		p.function.chunk.Write(b, p.Line)
+		p.function.chunk.Write(b, p.TokLine)
 	}
 }
 
@@ -88,7 +265,7 @@ func (p *Parser) emitJumpBack(start int) {
 	p.emitByte(byte(OP_JUMP_BACK))
 	offset := len(p.function.chunk.bytecode) - start + 2
 	if offset > UINT16_MAX {
-		p.isPanic = true
+		p.error(p.Peek(0).Start, "loop body too large")
 		return
 	}
 	p.emitByte(byte(offset>>8), byte(offset&255))
@@ -102,22 +279,70 @@ func (p *Parser) emitJump(instruction OpCode) int {
 func (p *Parser) patchJump(offset int) {
 	jump := len(p.function.chunk.bytecode) - offset - 2
 	if jump > UINT16_MAX {
-		p.isPanic = true
+		p.error(p.Peek(0).Start, "too much code to jump over")
 		return
 	}
 	p.function.chunk.bytecode[offset] = byte(jump >> 8)
 	p.function.chunk.bytecode[offset+1] = byte(jump & 255)
 }
 
+// slot of a global variable, allocated on first reference so functions can
+// refer to globals that are declared after them
+func (p *Parser) globalSlot(name Token) int {
+	if ind, ok := p.globalSlots[*name.Lit]; ok {
+		return ind
+	}
+	ind := len(p.globals)
+	if ind >= UINT16_MAX {
+		p.error(name.Start, "too many global variables")
+		return 0
+	}
+	p.globals = append(p.globals, Global{name: *name.Lit})
+	p.globalSlots[*name.Lit] = ind
+	return ind
+}
+
+// install read-only globals provided by the embedder, in name order so the
+// slots don't depend on map iteration
+func (p *Parser) predeclare(consts map[string]Value) {
+	names := make([]string, 0, len(consts))
+	for name := range consts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		p.globalSlots[name] = len(p.globals)
+		p.globals = append(p.globals, Global{name: name, defined: true, readonly: true, preset: true, value: consts[name]})
+	}
+}
+
+// a global named like a contextual builtin the file already compiled as the
+// builtin, that code would ignore the declaration
+func (p *Parser) builtinDeclared(name Token) {
+	if use, ok := p.builtins[*name.Lit]; ok {
+		p.error(use.Start, "%v is used as the builtin before its declaration", *name.Lit)
+		delete(p.builtins, *name.Lit)
+	}
+}
+
 // add new variable
-func (p *Parser) addVar(name_token Token) {
+func (p *Parser) addVar(name_token Token, readonly bool) {
 	if p.scopeDepth == 0 && p.top_level == true { // global
-		ind := p.function.chunk.AddConst(StringObject{inner: name_token.Lit})
-		p.emitByte(byte(OP_DEF_GLOBAL), byte(ind))
+		p.builtinDeclared(name_token)
+		ind := p.globalSlot(name_token)
+		if p.globals[ind].defined || p.imports[*name_token.Lit] != nil {
+			p.error(name_token.Start, "%v redeclared in this block", *name_token.Lit)
+		}
+		p.globals[ind].defined = true
+		p.globals[ind].readonly = p.globals[ind].readonly || readonly
+		p.emitByte(byte(OP_DEF_GLOBAL), byte(ind>>8), byte(ind&255))
 	} else { // local
-		lcl := Local{name: name_token, depth: p.scopeDepth}
+		lcl := Local{name: name_token, depth: p.scopeDepth, readonly: readonly}
+		if ind := p.localIndex(name_token); ind != -1 && p.locals[ind].depth == p.scopeDepth {
+			p.error(name_token.Start, "%v redeclared in this block", *name_token.Lit)
+		}
 		if len(p.locals) >= UINT8_MAX {
-			p.isPanic = true
+			p.error(name_token.Start, "too many local variables in function")
 			return
 		}
 		p.locals = append(p.locals, lcl)
@@ -125,19 +350,84 @@ func (p *Parser) addVar(name_token Token) {
 }
 
 func (p *Parser) varDecl() {
-	p.consume(LET)
+	decl := p.Next() // let or const
 	name_token := p.consume(IDENT)
 	p.consume(ASSIGN)
+	p.initializing = append(p.initializing, *name_token.Lit)
 	p.parseExpr(LOWEST_PREC + 1)
+	p.initializing = p.initializing[:len(p.initializing)-1]
 	p.consume(SEMI)
 
-	p.addVar(name_token)
+	p.addVar(name_token, decl.Kind == CONST)
 }
 
 func (p *Parser) funcDecl() {
 	p.consume(FUNC)
 	name_token := p.consume(IDENT)
+	f := p.funcBody(name_token.Lit)
+	p.emitConst(ObjVal(f))
+	p.addVar(name_token, false)
+	if p.scopeDepth > 0 || !p.top_level {
+		p.locals[len(p.locals)-1].fn = f
+		p.locals[len(p.locals)-1].used = p.hoist(name_token, f)
+	}
+}
+
+// Local functions are hoisted to the start of their block: references to the
+// name compiled earlier in the block, including from the function's own body
+// and from sibling functions, were compiled as globals and now load f instead.
+func (p *Parser) hoist(name Token, f *FuntionObject) bool {
+	slot, ok := p.globalSlots[*name.Lit]
+	if !ok || len(p.blocks) == 0 {
+		return false
+	}
+	rewritten := map[*Compiler]bool{}
+	found := false
+	for i := p.blocks[len(p.blocks)-1]; i < len(p.globalRefs); i++ {
+		ref := &p.globalRefs[i]
+		if ref.slot != slot || ref.hoisted {
+			continue
+		}
+		ref.hoisted = true
+		found = true
+		chunk := ref.compiler.function.chunk
+		if ref.compiler == p.Compiler {
+			// chunk is still being written, offsets are valid
+			p.loadFunction(chunk, ref.offset, ref.pos, name, f)
+			continue
+		}
+		// a finished, maybe optimized, nested function: every use of the slot
+		// in it refers to this block's function
+		if rewritten[ref.compiler] {
+			continue
+		}
+		rewritten[ref.compiler] = true
+		for off := 0; off < len(chunk.bytecode); off += 1 + operandSize(OpCode(chunk.bytecode[off])) {
+			op := OpCode(chunk.bytecode[off])
+			if (op == OP_GET_GLOBAL || op == OP_SET_GLOBAL) && int(chunk.bytecode[off+1])<<8|int(chunk.bytecode[off+2]) == slot {
+				p.loadFunction(chunk, off, ref.pos, name, f)
+			}
+		}
+	}
+	return found
+}
+
+// rewrite the global access at off into OP_CONST_LONG f, both are 3 bytes
+func (p *Parser) loadFunction(chunk *Chunk, off int, pos Position, name Token, f *FuntionObject) {
+	if OpCode(chunk.bytecode[off]) == OP_SET_GLOBAL {
+		p.error(pos, "cannot assign to function %v", *name.Lit)
+		return
+	}
+	ind := chunk.AddConstLong(ObjVal(f))
+	chunk.bytecode[off] = byte(OP_CONST_LONG)
+	chunk.bytecode[off+1] = byte(ind >> 8)
+	chunk.bytecode[off+2] = byte(ind & 255)
+}
+
+// compile `(params) { body }` into a new function object
+func (p *Parser) funcBody(name *string) *FuntionObject {
 	new_compiler := NewCompiler(p.Compiler, false)
+	new_compiler.function.name = name
 	p.Compiler = new_compiler
 	p.scopeDepth++
 
@@ -148,7 +438,8 @@ func (p *Parser) funcDecl() {
 			break
 		}
 		var_token := p.consume(IDENT)
-		p.addVar(var_token)
+		p.addVar(var_token, false)
+		p.locals[len(p.locals)-1].param = true
 		p.function.arity += 1
 		t = p.Peek(0)
 		if t.Kind == RPAREN || t.Kind == EOF {
@@ -160,19 +451,32 @@ func (p *Parser) funcDecl() {
 
 	p.block()
 
-	p.emitByte(byte(OP_NIL), byte(OP_RETURN))
-	f := p.Compiler.function
+	f := p.endFunction()
+	p.warnUnused(0)
 
 	p.Compiler = p.Compiler.enclosing
+	return f
+}
 
-	p.emitConst(f)
-	p.addVar(name_token)
+// warn about the locals declared deeper than depth that were never read
+func (p *Parser) warnUnused(depth int) {
+	for i := len(p.locals) - 1; i >= 0 && p.locals[i].depth > depth; i-- {
+		l := p.locals[i]
+		if l.used || strings.HasPrefix(*l.name.Lit, "_") {
+			continue
+		}
+		if l.param {
+			p.warn(l.name.Start, "unused parameter %v", *l.name.Lit)
+		} else {
+			p.warn(l.name.Start, "unused variable %v", *l.name.Lit)
+		}
+	}
 }
 
 func (p *Parser) stmt() {
 	t := p.Peek(0)
-	switch t.Kind {
-	case PRINT:
+	switch p.contextual(t, p.Peek(1).Kind) {
+	case PRINT, EPRINT:
 		p.printStmt()
 	case LBRACE:
 		p.blockStmt()
@@ -180,6 +484,22 @@ func (p *Parser) stmt() {
 		p.ifStmt()
 	case WHILE:
 		p.whileStmt()
+	case FOR:
+		p.forStmt()
+	case MATCH:
+		p.matchStmt()
+	case TRY:
+		p.tryStmt()
+	case THROW:
+		p.throwStmt()
+	case IMPORT:
+		p.importStmt()
+	case SPAWN:
+		p.spawnStmt()
+	case SEND:
+		p.sendStmt()
+	case CLOSE:
+		p.closeStmt()
 	case BREAK:
 		p.breakStmt()
 	case RETURN:
@@ -200,24 +520,25 @@ func (p *Parser) stmt() {
 }
 
 func (p *Parser) printStmt() {
-	p.consume(PRINT)
+	op := OP_PRINT
+	if p.Next().Kind != PRINT { // eprint is scanned as a name
+		op = OP_EPRINT
+	}
 
 	args_count := 0
 	for {
-		t := p.Peek(0)
-		if t.Kind == SEMI || t.Kind == EOF {
+		if p.stmtEnd() || p.Peek(0).Kind == EOF {
 			break
 		}
 		p.parseExpr(LOWEST_PREC + 1)
 		args_count += 1
-		t = p.Peek(0)
-		if t.Kind == SEMI || t.Kind == EOF {
+		if p.stmtEnd() || p.Peek(0).Kind == EOF {
 			break
 		}
 		p.consume(COMMA)
 	}
 	p.consume(SEMI)
-	p.emitByte(byte(OP_PRINT), byte(args_count))
+	p.emitByte(byte(op), byte(args_count))
 }
 func (p *Parser) emptyStmt() {
 	p.consume(SEMI)
@@ -229,15 +550,42 @@ func (p *Parser) exprStmt() {
 	p.emitByte(byte(OP_POP))
 }
 
-func (p *Parser) localIndex(name Token) int {
-	for i := len(p.locals) - 1; i >= 0; i -= 1 {
-		if *name.Lit == *p.locals[i].name.Lit {
+func (c *Compiler) localIndex(name Token) int {
+	for i := len(c.locals) - 1; i >= 0; i -= 1 {
+		if *name.Lit == *c.locals[i].name.Lit {
 			return i
 		}
 	}
 	return -1
 }
 
+// find the local, enclosing local function or global a name refers to
+func (p *Parser) resolve(name Token) varRef {
+	for _, init := range p.initializing {
+		if init == *name.Lit {
+			p.error(name.Start, "can't read %v in its own initializer", *name.Lit)
+			return varRef{kind: GLOBAL_VAR, name: name, invalid: true}
+		}
+	}
+	if ind := p.localIndex(name); ind != -1 {
+		p.locals[ind].used = true
+		return varRef{kind: LOCAL_VAR, ind: ind, name: name}
+	}
+	// functions can't capture locals of the function (or block) around them,
+	// local functions are constants so those are fine
+	for c := p.enclosing; c != nil; c = c.enclosing {
+		if ind := c.localIndex(name); ind != -1 {
+			if f := c.locals[ind].fn; f != nil {
+				c.locals[ind].used = true
+				return varRef{kind: FUNC_VAR, ind: p.function.chunk.AddConst(ObjVal(f)), name: name}
+			}
+			p.error(name.Start, "can't capture local variable %v of an enclosing scope", *name.Lit)
+			break
+		}
+	}
+	return varRef{kind: GLOBAL_VAR, ind: p.globalSlot(name), name: name}
+}
+
 func (p *Parser) opAssign(assign TokenKind) {
 	p.parseExpr(LOWEST_PREC + 1)
 	switch assign {
@@ -264,51 +612,80 @@ func (p *Parser) opAssign(assign TokenKind) {
 	}
 }
 
-func (p *Parser) getVar(is_local bool, ind int) {
-	if is_local {
-		p.emitByte(byte(OP_GET_LOCAL), byte(ind))
-	} else {
-		p.emitByte(byte(OP_GET_GLOBAL), byte(ind))
+func (p *Parser) getVar(v varRef) {
+	switch v.kind {
+	case LOCAL_VAR:
+		p.emitByte(byte(OP_GET_LOCAL), byte(v.ind))
+	case FUNC_VAR:
+		p.emitByte(byte(OP_CONST), byte(v.ind))
+	default:
+		p.refGlobal(v, false)
+		p.emitByte(byte(OP_GET_GLOBAL), byte(v.ind>>8), byte(v.ind&255))
 	}
 }
 
-func (p *Parser) setVar(is_local bool, ind int) {
-	if is_local {
-		p.emitByte(byte(OP_SET_LOCAL), byte(ind))
-	} else {
-		p.emitByte(byte(OP_SET_GLOBAL), byte(ind))
+func (p *Parser) setVar(v varRef) {
+	switch {
+	case v.kind == FUNC_VAR || (v.kind == LOCAL_VAR && p.locals[v.ind].fn != nil):
+		p.error(v.name.Start, "cannot assign to function %v", *v.name.Lit)
+	case v.kind == LOCAL_VAR && p.locals[v.ind].readonly:
+		p.error(v.name.Start, "cannot assign to constant %v", *v.name.Lit)
+	case v.kind == LOCAL_VAR:
+		p.emitByte(byte(OP_SET_LOCAL), byte(v.ind))
+	default:
+		p.refGlobal(v, true)
+		p.emitByte(byte(OP_SET_GLOBAL), byte(v.ind>>8), byte(v.ind&255))
 	}
 }
 
+// remember a global access that is about to be emitted
+func (p *Parser) refGlobal(v varRef, set bool) {
+	if v.invalid {
+		return
+	}
+	p.globalRefs = append(p.globalRefs, globalRef{
+		slot:     v.ind,
+		pos:      v.name.Start,
+		compiler: p.Compiler,
+		offset:   len(p.function.chunk.bytecode),
+		set:      set,
+	})
+}
+
 func (p *Parser) assignStmt(assign TokenKind) {
 	t := p.Next()
-	ind := p.localIndex(t)
-	is_local := ind != -1
-	if !is_local {
-		ind = p.function.chunk.AddConst(StringObject{inner: t.Lit})
-	}
+	v := p.resolve(t)
 	p.consume(assign)
 	switch assign {
 	case ASSIGN:
 		p.parseExpr(LOWEST_PREC + 1)
 	default:
-		p.getVar(is_local, ind)
+		p.getVar(v)
 		p.opAssign(assign)
 	}
 	p.consume(SEMI)
-	p.setVar(is_local, ind)
+	p.setVar(v)
 }
 
 func (p *Parser) block() {
 	p.consume(LBRACE)
+	p.blocks = append(p.blocks, len(p.globalRefs))
 
+	unreachable := false
 	for {
 		t := p.Peek(0)
 		if t.Kind == RBRACE || t.Kind == EOF {
 			break
 		}
+		if p.terminated && !unreachable && t.Kind != SEMI {
+			p.warn(t.Start, "unreachable code")
+			unreachable = true
+		}
+		p.terminated = false
 		p.decl()
 	}
+	p.terminated = false
+	p.blocks = p.blocks[:len(p.blocks)-1]
 	p.consume(RBRACE)
 }
 
@@ -317,7 +694,13 @@ func (p *Parser) blockStmt() {
 
 	p.block()
 
+	p.endScope()
+}
+
+// leave the innermost scope, popping its locals
+func (p *Parser) endScope() {
 	p.scopeDepth--
+	p.warnUnused(p.scopeDepth)
 	n := len(p.locals) - 1
 	for n >= 0 && p.locals[n].depth > p.scopeDepth {
 		p.emitByte(byte(OP_POP))
@@ -347,15 +730,133 @@ func (p *Parser) ifStmt() {
 	p.patchJump(jump_index_true)
 }
 
+// match value { 1, 2 => {} "a" => {} 3..=5 => {} _ => {} }
+// the value stays on the stack while the arms are tested, every pattern is
+// an OP_MATCH and a jump into its arm's block
+func (p *Parser) matchStmt() {
+	match_token := p.consume(MATCH)
+	p.parseExpr(LOWEST_PREC + 1)
+	p.consume(LBRACE)
+	ends := []int{}
+	has_default := false
+	for !p.syntaxErr {
+		t := p.Peek(0)
+		if t.Kind == SEMI { // inserted after an arm's } by autosemi
+			p.Next()
+			continue
+		}
+		if t.Kind == RBRACE || t.Kind == EOF {
+			break
+		}
+		if has_default {
+			p.error(t.Start, "default arm must be the last one")
+		}
+		if t.Kind == IDENT && *t.Lit == "_" {
+			p.Next()
+			p.consume(ARROW)
+			has_default = true
+			p.emitByte(byte(OP_POP))
+			p.blockStmt()
+			continue
+		}
+		bodies := []int{}
+		for {
+			p.pattern()
+			bodies = append(bodies, p.emitJump(OP_JUMP_IF_TRUE))
+			p.emitByte(byte(OP_POP))
+			if p.Peek(0).Kind != COMMA {
+				break
+			}
+			p.Next()
+		}
+		p.consume(ARROW)
+		next := p.emitJump(OP_JUMP)
+		for _, body := range bodies {
+			p.patchJump(body)
+		}
+		p.emitByte(byte(OP_POP), byte(OP_POP)) // the test result and the value
+		p.blockStmt()
+		ends = append(ends, p.emitJump(OP_JUMP))
+		p.patchJump(next)
+	}
+	p.consume(RBRACE)
+	if !has_default {
+		p.warn(match_token.Start, "match has no default arm")
+		p.emitByte(byte(OP_POP))
+	}
+	for _, end := range ends {
+		p.patchJump(end)
+	}
+	p.terminated = false
+}
+
+// compile one pattern of a match arm, a literal or a range of numbers
+func (p *Parser) pattern() {
+	val, ok := p.literal()
+	if !ok {
+		return
+	}
+	if kind := p.Peek(0).Kind; kind == RANGE || kind == RANGE_EQ {
+		p.Next()
+		hi_token := p.Peek(0)
+		hi, ok := p.literal()
+		if !ok {
+			return
+		}
+		if (!val.IsInt() && !val.IsFloat()) || val.kind != hi.kind {
+			p.error(hi_token.Start, "range bounds must be numbers of the same type")
+			return
+		}
+		val = ObjVal(&RangeObject{lo: val, hi: hi, inclusive: kind == RANGE_EQ})
+	}
+	p.emitByte(byte(OP_MATCH), byte(p.function.chunk.AddConst(val)))
+}
+
+// a literal in a pattern, numbers can be negative
+func (p *Parser) literal() (Value, bool) {
+	t := p.Next()
+	neg := t.Kind == SUB
+	if neg {
+		t = p.Next()
+	}
+	switch {
+	case t.Kind == INT_LIT || t.Kind == FLOAT_LIT:
+		val, ok := p.number(t)
+		if neg && val.IsInt() {
+			val = IntVal(-val.AsInt())
+		} else if neg {
+			val = FloatVal(-val.AsFloat())
+		}
+		return val, ok
+	case neg: // only numbers can be negated
+	case t.Kind == STR_LIT:
+		return StringVal(t.Lit), true
+	case t.Kind == BOOL_LIT:
+		return BoolVal(*t.Lit == "true"), true
+	case t.Kind == NIL:
+		return NilValue, true
+	}
+	p.error(t.Start, "expected pattern, found %v", t.Kind)
+	p.syntaxErr = true
+	return NilValue, false
+}
+
 func (p *Parser) breakStmt() {
+	t := p.consume(BREAK)
+	p.consume(SEMI)
 	if p.loopDepth == 0 {
-		p.isPanic = true
+		p.error(t.Start, "break outside a loop")
 		return
 	}
-	p.consume(BREAK)
-	p.consume(SEMI)
+	for i := len(p.locals) - 1; i >= p.loopLocals; i-- {
+		p.emitByte(byte(OP_POP))
+	}
+	for i := p.tries; i > p.loopTries; i-- {
+		p.emitByte(byte(OP_END_TRY))
+	}
 	exit := p.emitJump(OP_JUMP)
 	p.breaks = append(p.breaks, exit)
+	p.terminated = true
 }
 
 func (p *Parser) whileStmt() {
@@ -366,6 +867,8 @@ func (p *Parser) whileStmt() {
 	exit := p.emitJump(OP_JUMP_IF_FALSE)
 	p.emitByte(byte(OP_POP))
 
+	outer_breaks, outer_locals, outer_tries := p.breaks, p.loopLocals, p.loopTries
+	p.breaks, p.loopLocals, p.loopTries = nil, len(p.locals), p.tries
 	p.loopDepth += 1
 	p.blockStmt()
 	p.loopDepth -= 1
@@ -376,40 +879,173 @@ func (p *Parser) whileStmt() {
 	for _, end := range p.breaks {
 		p.patchJump(end)
 	}
-	p.breaks = p.breaks[:0]
+	p.breaks, p.loopLocals, p.loopTries = outer_breaks, outer_locals, outer_tries
+}
+
+// for x in generator() { ... } runs the block for every value the coroutine yields
+func (p *Parser) forStmt() {
+	p.consume(FOR)
+	name := p.consume(IDENT)
+	if in := p.consume(IDENT); *in.Lit != "in" && !p.syntaxErr {
+		p.error(in.Start, "expected in, found %v", *in.Lit)
+		p.syntaxErr = true
+	}
+	p.scopeDepth++
+	p.parseExpr(LOWEST_PREC + 1)
+	// the coroutine is kept in a local no script can name
+	hidden := " for"
+	p.addVar(Token{Kind: IDENT, Lit: &hidden, Start: name.Start}, false)
+	p.locals[len(p.locals)-1].used = true
+	slot := len(p.locals) - 1
+
+	start := len(p.function.chunk.bytecode)
+	p.emitByte(byte(OP_GET_LOCAL), byte(slot))
+	exit := p.emitJump(OP_FOR_ITER)
+
+	outer_breaks, outer_locals, outer_tries := p.breaks, p.loopLocals, p.loopTries
+	p.breaks, p.loopLocals, p.loopTries = nil, len(p.locals), p.tries
+	p.scopeDepth++
+	p.addVar(name, false) // the yielded value
+	p.loopDepth += 1
+	p.block()
+	p.loopDepth -= 1
+	p.endScope()
+
+	p.emitJumpBack(start)
+	p.patchJump(exit)
+	for _, end := range p.breaks {
+		p.patchJump(end)
+	}
+	p.breaks, p.loopLocals, p.loopTries = outer_breaks, outer_locals, outer_tries
+	p.endScope()
+}
+
+// spawn f(args); runs the call as a new task
+func (p *Parser) spawnStmt() {
+	spawn := p.consume(SPAWN)
+	p.lastCall = -1
+	p.parseExpr(LOWEST_PREC + 1)
+	p.consume(SEMI)
+	code := p.function.chunk.bytecode
+	if p.lastCall == -1 || p.lastCall != len(code)-2 {
+		p.error(spawn.Start, "spawn expects a call")
+		return
+	}
+	code[p.lastCall] = byte(OP_SPAWN)
+}
+
+// send ch, value;
+func (p *Parser) sendStmt() {
+	p.Next()
+	p.parseExpr(LOWEST_PREC + 1)
+	p.consume(COMMA)
+	p.parseExpr(LOWEST_PREC + 1)
+	p.consume(SEMI)
+	p.emitByte(byte(OP_SEND))
+}
+
+// close ch;
+func (p *Parser) closeStmt() {
+	p.Next()
+	p.parseExpr(LOWEST_PREC + 1)
+	p.consume(SEMI)
+	p.emitByte(byte(OP_CLOSE))
+}
+
+// try { ... } catch e { ... }
+// e is the thrown value, or the error when the VM raised it, and can be left out
+func (p *Parser) tryStmt() {
+	p.consume(TRY)
+	catch := p.emitJump(OP_TRY)
+	p.tries++
+	p.blockStmt()
+	p.tries--
+	p.emitByte(byte(OP_END_TRY))
+	end := p.emitJump(OP_JUMP)
+
+	p.patchJump(catch)
+	p.consume(CATCH)
+	p.scopeDepth++
+	if p.Peek(0).Kind == IDENT {
+		p.addVar(p.Next(), false) // the caught value is already on the stack
+	} else {
+		p.emitByte(byte(OP_POP))
+	}
+	p.block()
+	p.endScope()
+	p.patchJump(end)
+}
+
+func (p *Parser) throwStmt() {
+	p.consume(THROW)
+	p.parseExpr(LOWEST_PREC + 1)
+	p.consume(SEMI)
+	p.emitByte(byte(OP_THROW))
+	p.terminated = true
 }
 
 func (p *Parser) returnStmt() {
+	t := p.consume(RETURN)
 	if p.top_level == true {
-		p.isPanic = true
-		return
+		p.error(t.Start, "return outside a function")
 	}
-	p.consume(RETURN)
-	if p.Peek(0).Kind == SEMI {
+	if p.stmtEnd() {
 		p.emitByte(byte(OP_NIL), byte(OP_RETURN))
 	} else {
 		p.parseExpr(LOWEST_PREC + 1)
 		p.emitByte(byte(OP_RETURN))
 	}
 	p.consume(SEMI)
+	p.terminated = true
 }
 
 func (p *Parser) decl() {
 	t := p.Peek(0)
 	switch t.Kind {
 	case FUNC:
-		p.funcDecl()
-	case LET:
+		if p.Peek(1).Kind == IDENT {
+			p.funcDecl()
+		} else {
+			p.stmt() // function expression
+		}
+	case LET, CONST:
 		p.varDecl()
 	default:
 		p.stmt()
 	}
 }
 
+// the builtin a contextual name stands for, IDENT once the script declares
+// it, in scope or in a function being compiled so recursion works. send,
+// recv and close followed by ( are calls, their builtin forms take no
+// parentheses, while chan( and eprint( stay builtins. A global declared later can't change what was compiled, so
+// declaring a name after a builtin use is an error, see builtinDeclared
+func (p *Parser) contextual(t Token, next TokenKind) TokenKind {
+	if t.Kind != IDENT {
+		return t.Kind
+	}
+	kind, ok := Contextual[*t.Lit]
+	if !ok || p.imports[*t.Lit] != nil || next == LPAREN && kind != CHAN && kind != EPRINT {
+		return IDENT
+	}
+	for c := p.Compiler; c != nil; c = c.enclosing {
+		if c.localIndex(t) != -1 || c.function.name != nil && *c.function.name == *t.Lit {
+			return IDENT
+		}
+	}
+	if slot, ok := p.globalSlots[*t.Lit]; ok && p.globals[slot].defined {
+		return IDENT
+	}
+	if _, ok := p.builtins[*t.Lit]; !ok {
+		p.builtins[*t.Lit] = t
+	}
+	return kind
+}
+
 // pratt parser
 func (p *Parser) parseExpr(mprec int) {
 	lt := p.Next()
-	switch lt.Kind {
+	switch p.contextual(lt, p.Peek(0).Kind) {
 	case ADD:
 		p.parseExpr(HIGHEST_PREC)
 		p.emitByte(byte(OP_UNARY_ADD))
@@ -425,35 +1061,60 @@ func (p *Parser) parseExpr(mprec int) {
 	case LPAREN:
 		p.parseExpr(LOWEST_PREC + 1)
 		p.consume(RPAREN)
-	case INT_LIT:
-		ival, err := strconv.ParseInt(*lt.Lit, 10, 64)
-		if err != nil {
-			p.isPanic = true
-			return
-		}
-		p.emitConst(IntValue(ival))
-	case FLOAT_LIT:
-		fval, err := strconv.ParseFloat(*lt.Lit, 10)
-		if err != nil {
-			p.isPanic = true
+	case INT_LIT, FLOAT_LIT:
+		val, ok := p.number(lt)
+		if !ok {
 			return
 		}
-		p.emitConst(FloatValue(fval))
+		p.emitConst(val)
 	case STR_LIT:
-		p.emitConst(StringObject{inner: lt.Lit})
+		p.emitConst(StringVal(lt.Lit))
 	case BOOL_LIT:
-		p.emitConst(BoolValue(*lt.Lit == "true"))
+		p.emitConst(BoolVal(*lt.Lit == "true"))
 	case IDENT:
-		ind := p.localIndex(lt)
-		is_local := ind != -1
-		if !is_local {
-			ind = p.function.chunk.AddConst(StringObject{inner: lt.Lit})
+		if mod := p.imports[*lt.Lit]; mod != nil && p.localIndex(lt) == -1 {
+			p.selector(lt, mod)
+		} else {
+			p.getVar(p.resolve(lt))
 		}
-		p.getVar(is_local, ind)
 	case NIL:
-		p.emitConst(NilObject{})
-	default: // unreachable
-		p.isPanic = true
+		p.emitConst(NilValue)
+	case YIELD: // suspends the coroutine, evaluates to the value it is resumed with
+		if p.top_level {
+			p.error(lt.Start, "yield outside a function")
+		}
+		p.function.generator = true
+		switch p.Peek(0).Kind {
+		case SEMI, RPAREN, RBRACE, COMMA, COLON:
+			p.emitByte(byte(OP_NIL))
+		default:
+			p.parseExpr(LOWEST_PREC + 1)
+		}
+		p.emitByte(byte(OP_YIELD))
+	case CHAN: // chan() or chan(capacity)
+		p.consume(LPAREN)
+		if p.Peek(0).Kind == RPAREN {
+			p.emitConst(IntVal(0))
+		} else {
+			p.parseExpr(LOWEST_PREC + 1)
+		}
+		p.consume(RPAREN)
+		p.emitByte(byte(OP_CHAN))
+	case RECV: // recv ch, blocks until a value is sent or ch is closed
+		p.parseExpr(LPAREN.Prec())
+		p.emitByte(byte(OP_RECV))
+	case FUNC: // anonymous function
+		anonymous := ""
+		f := p.funcBody(&anonymous)
+		p.emitConst(ObjVal(f))
+	case ILLEGAL:
+		p.illegal(lt)
+		return
+	default:
+		if !p.syntaxErr {
+			p.error(lt.Start, "expected expression, found %v", lt.Kind)
+		}
+		p.syntaxErr = true
 		return
 	}
 	for {
@@ -480,6 +1141,7 @@ func (p *Parser) parseExpr(mprec int) {
 				p.consume(COMMA)
 			}
 			p.consume(RPAREN)
+			p.lastCall = len(p.function.chunk.bytecode)
 			p.emitByte(byte(OP_CALL), byte(args_count))
 		case MUL:
 			p.parseExpr(cprec + 1)
@@ -507,13 +1169,13 @@ func (p *Parser) parseExpr(mprec int) {
 			p.emitByte(byte(OP_LSS))
 		case LEQ:
 			p.parseExpr(cprec + 1)
-			p.emitByte(byte(OP_GTR), byte(OP_UNARY_NOT))
+			p.emitByte(byte(OP_LEQ))
 		case GTR:
 			p.parseExpr(cprec + 1)
 			p.emitByte(byte(OP_GTR))
 		case GEQ:
 			p.parseExpr(cprec + 1)
-			p.emitByte(byte(OP_LSS), byte(OP_UNARY_NOT))
+			p.emitByte(byte(OP_GEQ))
 		case EQL:
 			p.parseExpr(cprec + 1)
 			p.emitByte(byte(OP_EQL))
@@ -529,30 +1191,98 @@ func (p *Parser) parseExpr(mprec int) {
 		case OR:
 			p.parseExpr(cprec + 1)
 			p.emitByte(byte(OP_OR))
-		case LAND:
+		case LAND: // right operand is skipped when left is false
+			end := p.emitJump(OP_JUMP_IF_FALSE)
+			p.emitByte(byte(OP_POP))
 			p.parseExpr(cprec + 1)
-			p.emitByte(byte(OP_LAND))
-		case LOR:
+			p.patchJump(end)
+		case LOR: // right operand is skipped when left is true
+			end := p.emitJump(OP_JUMP_IF_TRUE)
+			p.emitByte(byte(OP_POP))
 			p.parseExpr(cprec + 1)
-			p.emitByte(byte(OP_LOR))
-		default: //unreachable
-			p.isPanic = true
+			p.patchJump(end)
+		case QUESTION: // cond ? a : b, only the chosen branch is evaluated
+			else_jump := p.emitJump(OP_JUMP_IF_FALSE)
+			p.emitByte(byte(OP_POP))
+			p.parseExpr(LOWEST_PREC + 1)
+			p.consume(COLON)
+			end := p.emitJump(OP_JUMP)
+			p.patchJump(else_jump)
+			p.emitByte(byte(OP_POP))
+			p.parseExpr(cprec) // right associative, a ? b : c ? d : e
+			p.patchJump(end)
+		default: // every token with a precedence is an operator above
+			p.error(op.Start, "unexpected %v", op.Kind)
+			p.syntaxErr = true
 			return
 		}
+		if op.Kind != LPAREN {
+			p.lastCall = -1 // a call in the operands of op isn't the whole expression
+		}
 	}
 	// parse primary expression
 }
 
 func (p *Parser) compile() {
+	defer func() {
+		// errors are reported where they are found, Compile and Check rely
+		// on a failed compile having one
+		if p.isPanic && p.err == nil && p.readErr == nil {
+			p.error(p.Peek(0).Start, "syntax error")
+		}
+	}()
+	p.loading = append(p.loading, p.path)
+	p.declarations()
+	if p.syntaxErr {
+		return
+	}
+	p.endFunction()
+	for _, ref := range p.globalRefs {
+		g := p.globals[ref.slot]
+		switch {
+		case ref.hoisted:
+		case !g.defined:
+			p.error(ref.pos, "undefined variable %v", g.name)
+		case ref.set && g.readonly:
+			// a const global may be declared after the function assigning it
+			p.error(ref.pos, "cannot assign to constant %v", g.name)
+		}
+	}
+	// unused variables are only known at the end of their scope
+	sort.SliceStable(p.Diagnostics, func(i, j int) bool {
+		a, b := p.Diagnostics[i], p.Diagnostics[j]
+		if a.File != b.File {
+			return a.File < b.File
+		}
+		return a.Pos.Offset < b.Pos.Offset
+	})
+}
+
+// compile the declarations of a file up to its end
+func (p *Parser) declarations() {
 	for {
-		if p.Peek(0).Kind == EOF {
-			break
+		t := p.Peek(0)
+		if t.Kind == EOF {
+			return
 		}
-		if p.Peek(0).Kind == ILLEGAL {
-			p.isPanic = true
+		if t.Kind == ILLEGAL {
+			p.illegal(t)
+			p.syntaxErr = true
 			return
 		}
 		p.decl()
+		if p.syntaxErr {
+			return
+		}
 	}
+}
+
+// emit the implicit return and optimize the finished chunk
+func (p *Parser) endFunction() *FuntionObject {
 	p.emitByte(byte(OP_NIL), byte(OP_RETURN))
+	f := p.function
+	if p.optimize && !f.chunk.Optimize() {
+		p.error(p.Peek(0).Start, "%v too large to optimize", f)
+	}
+	return f
 }
@@ -0,0 +1,109 @@
+package glox
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestDiagnostics(t *testing.T) {
+	tests := []struct {
+		src  string
+		want []string
+	}{
+		{"fn f() { let x = 1; let x = 2; return x; }", []string{
+			"warning: unused variable x:1:14",
+			"x redeclared in this block:1:25",
+		}},
+		{"fn f() { let a = a; return a; }", []string{"can't read a in its own initializer:1:18"}},
+		{"let g = 1;\nlet g = 2;", []string{"g redeclared in this block:2:5"}},
+		{"fn f(a, _b) { return 1; }", []string{"warning: unused parameter a:1:6"}},
+		{"fn f() { return 1; print 2; }", []string{"warning: unreachable code:1:20"}},
+		{"while true { break; ; }", nil},
+		{"fn f() { let x = 1; { let x = 2; print x; } print x; }", nil},
+		{"print y;", []string{"undefined variable y:1:7"}},
+		{"let x = 1", []string{"expected SEMI, found EOF:1:10"}},
+		{"fn f() { const x = 1; x += 2; return x; }", []string{"cannot assign to constant x:1:23"}},
+		{"fn f() { c = 2; }\nconst c = 1;", []string{"cannot assign to constant c:1:10"}},
+		{"const c = 1;\nlet c = 2;", []string{"c redeclared in this block:2:5"}},
+		{"let a = 1 < 2 ? 1 : 2 > 3 ? 3 : 4;", nil},
+		{"print true ? 1;", []string{"expected COLON, found SEMI:1:15"}},
+		{"let x = (1;\nlet y = 2;", []string{"expected RPAREN, found SEMI:1:11"}},
+		{"match 1 { 1 => {} }", []string{"warning: match has no default arm:1:1"}},
+		{"match 1 { _ => {} 1 => {} }", []string{"default arm must be the last one:1:19"}},
+		{"match 1 { 1..2.5 => {} _ => {} }", []string{"range bounds must be numbers of the same type:1:14"}},
+		{"match 1 { -\"a\" => {} }", []string{"expected pattern, found STR_LIT:1:12"}},
+		{"yield 1;", []string{"yield outside a function:1:1"}},
+		{"for x on g() {}", []string{"expected in, found on:1:7"}},
+		{"let x = );", []string{"expected expression, found RPAREN:1:9"}},
+		{"print 1 +;\nprint 2;", []string{"expected expression, found SEMI:1:10"}},
+		{"return 1;", []string{"return outside a function:1:1"}},
+		{"break;\nprint 1;", []string{"break outside a loop:1:1"}},
+		{"fn f() { break; }", []string{"break outside a loop:1:10"}},
+		{"while true { fn f() { break; } }", []string{
+			"warning: unused variable f:1:17",
+			"break outside a loop:1:23",
+		}},
+		{"fn f() { return 1 }", []string{"expected SEMI, found RBRACE:1:19"}},
+		{"//glox:autosemi\nif true { print 1 }", nil},
+		{"//glox:autosemi\nfn f() { return }\nf()", nil},
+	}
+	for _, tt := range tests {
+		got := Check(tt.src, Options{})
+		if len(got) != len(tt.want) {
+			t.Errorf("%q: got %v, want %v", tt.src, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i].Error() != tt.want[i] {
+				t.Errorf("%q: got %q, want %q", tt.src, got[i].Error(), tt.want[i])
+			}
+		}
+	}
+}
+
+func TestConsts(t *testing.T) {
+	name := "glox"
+	opts := Options{Consts: map[string]Value{"max": IntVal(3), "name": StringVal(&name)}}
+	if err := InterpretWithOptions("let n = max; print n, name;", opts); err != nil {
+		t.Fatal(err)
+	}
+	for _, src := range []string{"max = 4;", "let max = 4;", "fn f() { max -= 1; }"} {
+		if err := InterpretWithOptions(src, opts); err == nil {
+			t.Errorf("%q: assigning an embedded constant compiled", src)
+		}
+	}
+}
+
+// code past the limits of the bytecode fails to compile with a positioned
+// error, the scripts use no constants to stay under that limit
+func TestCompileLimits(t *testing.T) {
+	var locals, loop strings.Builder
+	locals.WriteString("fn f(p) {\n")
+	for i := range 300 {
+		fmt.Fprintf(&locals, "    let a%d = p;\n", i)
+	}
+	locals.WriteString("}")
+	loop.WriteString("let x = 0;\nwhile false {\n")
+	for range 10_000 {
+		loop.WriteString("    x = x + x;\n")
+	}
+	loop.WriteString("}")
+
+	tests := []struct {
+		src  string
+		msg  string
+		line int
+	}{
+		{locals.String(), "too many local variables in function", 256},
+		{loop.String(), "loop body too large", 10_003},
+	}
+	for _, tt := range tests {
+		_, err := Compile(tt.src, Options{NoOptimize: true})
+		var d Diagnostic
+		if !errors.As(err, &d) || d.Msg != tt.msg || d.Pos.Line != tt.line {
+			t.Errorf("got %v, want %v at line %v", err, tt.msg, tt.line)
+		}
+	}
+}
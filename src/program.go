@@ -0,0 +1,58 @@
+package glox
+
+import "io"
+
+// Program is a compiled script. Nothing changes it after it is compiled, so
+// any number of VMs, in any number of goroutines, can run it at once. A VM
+// keeps its own stacks, frames and globals
+type Program struct {
+	script  *FuntionObject
+	globals []Global
+}
+
+// Compile compiles a script without running it, warnings go to opts.Warn
+func Compile(input string, opts Options) (*Program, error) {
+	return compile(NewParser(input), opts)
+}
+
+// CompileReader compiles a script read from r
+func CompileReader(r io.Reader, opts Options) (*Program, error) {
+	return compile(NewReaderParser(r), opts)
+}
+
+func compile(p *Parser, opts Options) (*Program, error) {
+	p.configure(opts)
+	p.compile()
+	for _, d := range p.Diagnostics {
+		if d.Severity == WARNING && opts.Warn != nil {
+			opts.Warn(d)
+		}
+	}
+	if p.readErr != nil {
+		return nil, p.readErr
+	}
+	if p.err != nil {
+		return nil, p.err
+	}
+	return &Program{script: p.function, globals: p.globals}, nil
+}
+
+// Run executes prog from the start, a VM can run one program at a time
+func (vm *VM) Run(prog *Program) error {
+	if len(vm.frames) < FRAMES_INIT { // the last run ended in a coroutine or task
+		vm.frames = make([]CallFrame, FRAMES_INIT)
+	}
+	main := &task{}
+	vm.sp, vm.frame_count, vm.handlers = 0, 0, nil
+	vm.resumers, vm.ready, vm.current, vm.main = nil, nil, main, main
+	vm.isPanic = false
+	vm.executed, vm.slice, vm.steps = 0, 0, 0
+	vm.peak_memory = 0
+	vm.setGlobals(prog.globals)
+	vm.call(prog.script, 0)
+	vm.collect(0)
+	err := vm.run()
+	vm.ready = nil // like in Go, the other tasks end with the main script
+	vm.collect(0)  // Stats counts only what the script still holds
+	return err
+}
@@ -0,0 +1,89 @@
+package glox
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const shared = `
+const LIMIT = 20;
+fn fib(n) { return n < 2 ? n : fib(n - 1) + fib(n - 2); }
+fn evens(n) { let i = 0; while i < n { yield i; i += 2; } }
+let total = 0;
+for e in evens(LIMIT) { total += e; }
+let kind = 0;
+match fib(10) { 55 => { kind = 1; } _ => {} }
+try { throw kind; } catch e { kind = e; }
+let c = chan();
+spawn fn () { send c, fib(15); }();
+if total != 90 || kind != 1 || recv c != 610 { throw total; }
+`
+
+// fingerprint dumps a function and every function in its constants
+func fingerprint(b *strings.Builder, fun *FuntionObject) {
+	fmt.Fprintf(b, "%v %d %v %v %v\n", fun, fun.arity, fun.generator, fun.chunk.bytecode, fun.chunk.lines)
+	for _, c := range fun.chunk.consts {
+		if f, ok := c.AsFunction(); ok {
+			fingerprint(b, f)
+			continue
+		}
+		fmt.Fprintf(b, "%d %d %v\n", c.kind, c.bits, c)
+	}
+}
+
+func TestProgramShared(t *testing.T) {
+	prog, err := Compile(shared, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var before strings.Builder
+	fingerprint(&before, prog.script)
+
+	var wg sync.WaitGroup
+	errs := make([]error, 200)
+	for i := range errs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			vm := NewVM()
+			for range 3 { // a VM can run the same program again
+				if errs[i] = vm.Run(prog); errs[i] != nil {
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var after strings.Builder
+	fingerprint(&after, prog.script)
+	if before.String() != after.String() {
+		t.Errorf("running the program changed it\nbefore:\n%s\nafter:\n%s", before.String(), after.String())
+	}
+}
+
+// a VM left inside a task or coroutine by an error starts clean on the next run
+func TestProgramRunAfterError(t *testing.T) {
+	bad, err := Compile("fn g() { yield 1; throw \"x\"; } for v in g() {}", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	good, err := Compile(shared, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm := NewVM()
+	if err := vm.Run(bad); err == nil {
+		t.Fatal("expected an error")
+	}
+	if err := vm.Run(good); err != nil {
+		t.Fatal(err)
+	}
+}
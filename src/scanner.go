@@ -2,51 +2,147 @@ package glox
 
 import (
 	"fmt"
+	"io"
+	"unicode"
+	"unicode/utf8"
 )
 
+const LOOKAHEAD_MAX = 4 // size of the token ring buffer, must be a power of two
+const READ_SIZE = 4096  // bytes requested from the reader per refill
+
+// Scanner lexes UTF-8 source a byte at a time, runes are only decoded for
+// characters outside ASCII. With a reader only a small window of the input
+// is kept in memory.
 type Scanner struct {
-	Input    []rune
-	Index    int
-	Len      int
+	src      []byte // unconsumed input window
+	pos      int    // index of the next byte in src
+	r        io.Reader
+	readErr  error
+	Offset   int      // byte offset of the next byte in the whole input
+	start    Position // start of the token being lexed
 	Line     int
+	Column   int // in characters, 1 based
 	isPanic  bool
+	buf      [LOOKAHEAD_MAX]Token // tokens lexed by Peek but not yet returned by Next
+	head     int
+	buffered int
+	TokLine  int       // line of the last token returned by Next
+	AutoSemi bool      // insert SEMI at line ends, see insertSemi
+	lastKind TokenKind // kind of the last lexed token, ILLEGAL before the first one
 }
 
+// a file starting with this line comment opts in to automatic semicolons
+const AUTOSEMI_DIRECTIVE = "glox:autosemi"
+
 func NewScanner(input string) *Scanner {
-	input_runes := []rune(input)
 	return &Scanner{
-		Input: input_runes,
-		Line:  1,
-		Index: 0,
-		Len:   len(input_runes),
+		src:    []byte(input),
+		Line:   1,
+		Column: 1,
 	}
 }
 
-func (sc *Scanner) lookahead(ind int) rune {
-	if sc.Index+ind < sc.Len {
-		return sc.Input[sc.Index+ind]
+// NewReaderScanner reads the source lazily from r
+func NewReaderScanner(r io.Reader) *Scanner {
+	return &Scanner{
+		src:    make([]byte, 0, READ_SIZE),
+		r:      r,
+		Line:   1,
+		Column: 1,
+	}
+}
+
+// make sure n bytes past pos are buffered, unless the input ends first
+func (sc *Scanner) fill(n int) bool {
+	for sc.pos+n >= len(sc.src) {
+		if sc.r == nil {
+			return false
+		}
+		// drop consumed bytes, literals are copied out of the window
+		remaining := copy(sc.src, sc.src[sc.pos:])
+		sc.src = sc.src[:remaining]
+		sc.pos = 0
+		if cap(sc.src)-remaining < READ_SIZE {
+			src := make([]byte, remaining, 2*cap(sc.src)+READ_SIZE)
+			copy(src, sc.src)
+			sc.src = src
+		}
+		m, err := sc.r.Read(sc.src[remaining : remaining+READ_SIZE])
+		sc.src = sc.src[:remaining+m]
+		if err != nil {
+			if err != io.EOF {
+				sc.readErr = err
+				sc.isPanic = true
+			}
+			sc.r = nil
+		}
+	}
+	return true
+}
+
+func (sc *Scanner) lookahead(ind int) byte {
+	if sc.pos+ind < len(sc.src) || sc.fill(ind) {
+		return sc.src[sc.pos+ind]
 	}
 	return 0
 }
 
-func (sc *Scanner) consume(c rune) {
+func (sc *Scanner) consume(c byte) {
 	ch := sc.lookahead(0)
 	if ch != c {
 		sc.isPanic = true
 	}
-	sc.Index += 1
+	sc.pos += 1
+	sc.Offset += 1
+	if ch&0xC0 != 0x80 { // continuation bytes don't start a new character
+		sc.Column += 1
+	}
+	if ch == '\n' {
+		sc.Line += 1
+		sc.Column = 1
+	}
+}
+
+// decode the character at the current position without consuming it
+func (sc *Scanner) peekRune() (rune, int) {
+	if ch := sc.lookahead(0); ch < utf8.RuneSelf {
+		return rune(ch), 1
+	}
+	sc.fill(utf8.UTFMax - 1)
+	return utf8.DecodeRune(sc.src[sc.pos:])
+}
+
+func (sc *Scanner) position() Position {
+	return Position{Offset: sc.Offset, Line: sc.Line, Column: sc.Column}
+}
+
+// consume a whole, possibly multi byte, character
+func (sc *Scanner) consumeRune() rune {
+	sc.fill(utf8.UTFMax - 1)
+	ch, size := utf8.DecodeRune(sc.src[sc.pos:])
+	if size == 0 {
+		size = 1
+	}
+	sc.pos += size
+	sc.Offset += size
+	sc.Column += 1
 	if ch == '\n' {
 		sc.Line += 1
+		sc.Column = 1
 	}
+	return ch
 }
 
-func (sc *Scanner) readInt() ([]rune, bool) {
-	str := []rune{}
+// read digits accepted by isValid, single '_' separators are dropped,
+// a malformed sequence is returned as written
+func (sc *Scanner) readDigits(isValid func(byte) bool) ([]byte, bool) {
+	str := []byte{}
+	raw := []byte{}
 	ch := sc.lookahead(0)
 	var max_underscore = 0
 	var cur_underscore = 0
-	var end_char = '_'
-	for isDigit(ch) || ch == '_' {
+	var end_char byte = '_'
+	for isValid(ch) || ch == '_' {
 		if ch == '_' {
 			cur_underscore += 1
 			if cur_underscore > max_underscore {
@@ -57,35 +153,95 @@ func (sc *Scanner) readInt() ([]rune, bool) {
 			str = append(str, ch)
 		}
 		end_char = ch
+		raw = append(raw, ch)
 		sc.consume(ch)
 		ch = sc.lookahead(0)
 	}
 	if max_underscore > 1 || end_char == '_' {
 		sc.isPanic = true
-		return str, false
+		return raw, false
 	}
 	return str, true
 }
 
+func (sc *Scanner) readInt() ([]byte, bool) {
+	return sc.readDigits(isDigit)
+}
+
+func (sc *Scanner) invalidNumber(lit []byte, lin int) Token {
+	sc.isPanic = true
+	// skip the rest of the malformed literal
+	for isNameStart(sc.lookahead(0)) || isDigit(sc.lookahead(0)) {
+		lit = append(lit, sc.lookahead(0))
+		sc.consume(sc.lookahead(0))
+	}
+	errorMsg := fmt.Sprintf("invalid number literal %s", string(lit))
+	return NewToken(ILLEGAL, &errorMsg, lin)
+}
+
+// decimal ints and floats, 0x 0o 0b prefixed ints, 1e9 2.5e-3 .5 style floats
 func (sc *Scanner) lexNumber() Token {
 	lin := sc.Line
-	left, ok := sc.readInt()
-	if !ok {
-		errorMsg := fmt.Sprintf("invalid number literal %s", string(left))
-		return NewToken(ILLEGAL, &errorMsg, lin)
+	if sc.lookahead(0) == '0' {
+		var isValid func(byte) bool
+		switch sc.lookahead(1) {
+		case 'x', 'X':
+			isValid = isHexDigit
+		case 'o', 'O':
+			isValid = isOctalDigit
+		case 'b', 'B':
+			isValid = isBinaryDigit
+		}
+		if isValid != nil {
+			prefix := []byte{'0', sc.lookahead(1) | 0x20} // lower case base letter
+			sc.consume('0')
+			sc.consume(sc.lookahead(0))
+			digits, ok := sc.readDigits(isValid)
+			lit := append(prefix, digits...)
+			if !ok || len(digits) == 0 || isNameStart(sc.lookahead(0)) || isDigit(sc.lookahead(0)) {
+				return sc.invalidNumber(lit, lin)
+			}
+			value_lit := string(lit)
+			return NewToken(INT_LIT, &value_lit, lin)
+		}
+	}
+
+	left := []byte{'0'} // leading dot floats
+	if sc.lookahead(0) != '.' {
+		var ok bool
+		left, ok = sc.readInt()
+		if !ok {
+			return sc.invalidNumber(left, lin)
+		}
 	}
 	NumToken := INT_LIT
-	if sc.lookahead(0) == rune('.') && isDigit(sc.lookahead(1)) {
+	if sc.lookahead(0) == '.' && isDigit(sc.lookahead(1)) {
 		sc.consume(sc.lookahead(0))
 		right, ok := sc.readInt()
-		if !ok {
-			errorMsg := fmt.Sprintf("invalid number literal %s", string(left))
-			return NewToken(ILLEGAL, &errorMsg, lin)
-		}
 		left = append(left, '.')
 		left = append(left, right...)
+		if !ok {
+			return sc.invalidNumber(left, lin)
+		}
 		NumToken = FLOAT_LIT
 	}
+	if ch := sc.lookahead(0); ch == 'e' || ch == 'E' {
+		sc.consume(ch)
+		left = append(left, 'e')
+		if sign := sc.lookahead(0); sign == '+' || sign == '-' {
+			sc.consume(sign)
+			left = append(left, sign)
+		}
+		exp, ok := sc.readInt()
+		left = append(left, exp...)
+		if !ok || len(exp) == 0 {
+			return sc.invalidNumber(left, lin)
+		}
+		NumToken = FLOAT_LIT
+	}
+	if isNameStart(sc.lookahead(0)) || isDigit(sc.lookahead(0)) {
+		return sc.invalidNumber(left, lin)
+	}
 	value_lit := string(left)
 	return NewToken(NumToken, &value_lit, lin)
 }
@@ -99,21 +255,58 @@ func (sc *Scanner) AssignOp(op, aop TokenKind, lin int) Token {
 	return NewToken(op, nil, lin)
 }
 
+// Next returns the next token, every character is only lexed once
 func (sc *Scanner) Next() Token {
+	var tok Token
+	if sc.buffered > 0 {
+		tok = sc.buf[sc.head]
+		sc.head = (sc.head + 1) & (LOOKAHEAD_MAX - 1)
+		sc.buffered--
+	} else {
+		tok = sc.lex()
+	}
+	sc.TokLine = tok.Line
+	return tok
+}
+
+// lex one token and record where it starts and ends
+func (sc *Scanner) lex() Token {
+	tok := sc.scan()
+	tok.Start = sc.start
+	tok.End = sc.position()
+	sc.lastKind = tok.Kind
+	return tok
+}
+
+// Go's semicolon rule, a line ending after one of these tokens ends the statement
+func (sc *Scanner) insertSemi() bool {
+	if !sc.AutoSemi {
+		return false
+	}
+	switch sc.lastKind {
+	case IDENT, STR_LIT, BOOL_LIT, INT_LIT, FLOAT_LIT, NIL, RPAREN, RBRACE, RETURN, BREAK, CONTINUE:
+		return true
+	}
+	return false
+}
+
+func (sc *Scanner) scan() Token {
 	for isWhitespace(sc.lookahead(0)) {
 		sc.consume(sc.lookahead(0))
 	}
+	sc.start = sc.position()
 
 	lin := sc.Line
 	ch := sc.lookahead(0)
-	if isNameStart(ch) {
-		sc.consume(ch)
-		name := []rune{ch}
-		ch = sc.lookahead(0)
-		for isNameStart(ch) || isDigit(ch) {
-			name = append(name, ch)
-			sc.consume(ch)
-			ch = sc.lookahead(0)
+	if r, _ := sc.peekRune(); isLetter(r) {
+		name := []byte{}
+		for {
+			r, size := sc.peekRune()
+			if !isLetter(r) && !isUnicodeDigit(r) {
+				break
+			}
+			name = append(name, sc.src[sc.pos:sc.pos+size]...)
+			sc.consumeRune()
 		}
 		name_str := string(name)
 		if name_str == "true" || name_str == "false" {
@@ -129,8 +322,13 @@ func (sc *Scanner) Next() Token {
 	}
 
 	switch ch {
-	case rune(0):
-		sc.consume(ch)
+	case 0:
+		if sc.pos < len(sc.src) { // NUL byte inside the input
+			break
+		}
+		if sc.insertSemi() {
+			return NewToken(SEMI, nil, lin)
+		}
 		return NewToken(EOF, nil, lin)
 	case ';':
 		sc.consume(ch)
@@ -138,10 +336,18 @@ func (sc *Scanner) Next() Token {
 	case ',':
 		sc.consume(',')
 		return NewToken(COMMA, nil, lin)
+	case ':':
+		sc.consume(ch)
+		return NewToken(COLON, nil, lin)
+	case '?':
+		sc.consume(ch)
+		return NewToken(QUESTION, nil, lin)
 	case '\n':
 		sc.consume(ch)
-		return sc.Next()
-		// return NewToken(Nline, []rune{}, lin)
+		if sc.insertSemi() {
+			return NewToken(SEMI, nil, lin)
+		}
+		return sc.scan()
 	case '+':
 		return sc.AssignOp(ADD, ADD_ASSIGN, lin)
 	case '-':
@@ -153,18 +359,23 @@ func (sc *Scanner) Next() Token {
 		if sc.lookahead(1) == '/' {
 			sc.consume('/')
 			sc.consume('/')
-			comment := []rune{}
+			comment := []byte{}
 			for sc.lookahead(0) != '\n' && sc.lookahead(0) != 0 {
-				comment = append(comment, sc.lookahead(0))
+				if sc.lastKind == ILLEGAL { // directives only before the first token
+					comment = append(comment, sc.lookahead(0))
+				}
 				sc.consume(sc.lookahead(0))
 			}
-			return sc.Next() // skip comment
+			if string(comment) == AUTOSEMI_DIRECTIVE {
+				sc.AutoSemi = true
+			}
+			return sc.scan() // skip comment
 		}
 		// multiline comment
 		if sc.lookahead(1) == '*' {
 			sc.consume('/')
 			sc.consume('*')
-			comment := []rune{}
+			start_line := sc.Line
 			for {
 				if sc.lookahead(0) == 0 {
 					sc.isPanic = true
@@ -174,19 +385,31 @@ func (sc *Scanner) Next() Token {
 				if sc.lookahead(0) == '*' && sc.lookahead(1) == '/' {
 					break
 				}
-				comment = append(comment, sc.lookahead(0))
 				sc.consume(sc.lookahead(0))
 			}
 			sc.consume('*')
 			sc.consume('/')
-			return sc.Next() // skip comment
+			if sc.Line != start_line && sc.insertSemi() { // acts like a newline
+				return NewToken(SEMI, nil, lin)
+			}
+			return sc.scan() // skip comment
 		}
 		return sc.AssignOp(DIV, DIV_ASSIGN, lin)
 	case '%':
 		return sc.AssignOp(MOD, MOD_ASSIGN, lin)
 	case '|':
+		if sc.lookahead(1) == '|' {
+			sc.consume('|')
+			sc.consume('|')
+			return NewToken(LOR, nil, lin)
+		}
 		return sc.AssignOp(OR, OR_ASSIGN, lin)
 	case '&':
+		if sc.lookahead(1) == '&' {
+			sc.consume('&')
+			sc.consume('&')
+			return NewToken(LAND, nil, lin)
+		}
 		return sc.AssignOp(AND, AND_ASSIGN, lin)
 	case '^':
 		return sc.AssignOp(XOR, XOR_ASSIGN, lin)
@@ -216,6 +439,10 @@ func (sc *Scanner) Next() Token {
 			sc.consume('=')
 			return NewToken(EQL, nil, lin)
 		}
+		if sc.lookahead(0) == '>' {
+			sc.consume('>')
+			return NewToken(ARROW, nil, lin)
+		}
 		return NewToken(ASSIGN, nil, lin)
 	case '!':
 		sc.consume(ch)
@@ -241,9 +468,24 @@ func (sc *Scanner) Next() Token {
 		return NewToken(TILDE, nil, lin)
 	case '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
 		return sc.lexNumber()
+	case '.':
+		if isDigit(sc.lookahead(1)) {
+			return sc.lexNumber()
+		}
+		if sc.lookahead(1) == '.' {
+			sc.consume('.')
+			sc.consume('.')
+			if sc.lookahead(0) == '=' {
+				sc.consume('=')
+				return NewToken(RANGE_EQ, nil, lin)
+			}
+			return NewToken(RANGE, nil, lin)
+		}
+		sc.consume(ch)
+		return NewToken(DOT, nil, lin)
 	case '"':
 		sc.consume(ch)
-		str := []rune{}
+		str := []byte{}
 		ch = sc.lookahead(0)
 		for ch != '"' {
 			if ch == '\n' || ch == 0 {
@@ -258,36 +500,60 @@ func (sc *Scanner) Next() Token {
 		str_str := string(str)
 		return NewToken(STR_LIT, &str_str, lin)
 	}
-	sc.consume(ch) // keep going even if character is invalid
+	sc.consumeRune() // keep going even if character is invalid
 	sc.isPanic = true
 	return NewToken(ILLEGAL, nil, lin)
 }
 
+// Peek returns the token d positions ahead without consuming it, d < LOOKAHEAD_MAX
 func (sc *Scanner) Peek(d int) Token {
-	pos := sc.Index
-	lin := sc.Line
-	var tok Token
-	for _ = range d + 1 {
-		tok = sc.Next()
+	for sc.buffered <= d {
+		sc.buf[(sc.head+sc.buffered)&(LOOKAHEAD_MAX-1)] = sc.lex()
+		sc.buffered++
 	}
-	sc.Index = pos
-	sc.Line = lin
-	return tok
+	return sc.buf[(sc.head+d)&(LOOKAHEAD_MAX-1)]
 }
 
-func isDigit(ch rune) bool {
+func isDigit(ch byte) bool {
 	return ch >= '0' && ch <= '9'
 }
 
-func isAlpha(ch rune) bool {
+func isHexDigit(ch byte) bool {
+	return isDigit(ch) || (ch >= 'a' && ch <= 'f') || (ch >= 'A' && ch <= 'F')
+}
+
+func isOctalDigit(ch byte) bool {
+	return ch >= '0' && ch <= '7'
+}
+
+func isBinaryDigit(ch byte) bool {
+	return ch == '0' || ch == '1'
+}
+
+func isAlpha(ch byte) bool {
 	return (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z')
 }
 
 // new line is a Token
-func isWhitespace(ch rune) bool {
+func isWhitespace(ch byte) bool {
 	return ch == ' ' || ch == '\t' || ch == '\r'
 }
 
-func isNameStart(ch rune) bool {
+func isNameStart(ch byte) bool {
 	return ch == '_' || isAlpha(ch)
 }
+
+// identifiers follow Go's rules, letters and digits of any script
+func isLetter(r rune) bool {
+	if r < utf8.RuneSelf {
+		return isNameStart(byte(r))
+	}
+	return unicode.IsLetter(r)
+}
+
+func isUnicodeDigit(r rune) bool {
+	if r < utf8.RuneSelf {
+		return isDigit(byte(r))
+	}
+	return unicode.IsDigit(r)
+}
@@ -0,0 +1,161 @@
+package glox
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+// a function with comments, literals and most operators, repeated n times
+func generateFunctions(n int) string {
+	var sb strings.Builder
+	for i := range n {
+		fmt.Fprintf(&sb, `// function number %d
+fn f%d(a, b) {
+    /* multi
+       line */
+    let c = a * 2 + b - 1_000;
+    if c >= 10 && b != 3 || !(a < b) {
+        c -= 1;
+    }
+    print "value", c, 2.5;
+    return c;
+}
+`, i, i)
+	}
+	return sb.String()
+}
+
+// n assignments at top level, no constants so the chunk never overflows
+func generateAssigns(n int) string {
+	var sb strings.Builder
+	sb.WriteString("let x = 1;\nlet y = 2;\nlet z = 3;\n")
+	for range n {
+		sb.WriteString("x = x + y * (x - y) ^ z; // mix\n")
+	}
+	return sb.String()
+}
+
+func BenchmarkScanner(b *testing.B) {
+	for _, n := range []int{100, 1_000, 10_000} {
+		src := generateFunctions(n)
+		b.Run(fmt.Sprintf("funcs=%d", n), func(b *testing.B) {
+			b.SetBytes(int64(len(src)))
+			for range b.N {
+				sc := NewScanner(src)
+				for sc.Next().Kind != EOF {
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkCompile(b *testing.B) {
+	for _, n := range []int{100, 1_000, 10_000} {
+		src := generateAssigns(n)
+		b.Run(fmt.Sprintf("stmts=%d", n), func(b *testing.B) {
+			b.SetBytes(int64(len(src)))
+			for range b.N {
+				p := NewParser(src)
+				p.compile()
+				if p.isPanic {
+					b.Fatal(p.err)
+				}
+			}
+		})
+	}
+}
+
+// reading through a tiny window must give the same tokens and offsets as a string
+func TestReaderScanner(t *testing.T) {
+	src := generateFunctions(50) + `print "héllo wörld", x; // ünïcode`
+	want := NewScanner(src)
+	got := NewReaderScanner(iotest.OneByteReader(strings.NewReader(src)))
+	for {
+		w, g := want.Next(), got.Next()
+		if w.Kind != g.Kind || w.Line != g.Line || w.Start != g.Start || w.End != g.End {
+			t.Fatalf("got %v [%v-%v], want %v [%v-%v]", g, g.Start, g.End, w, w.Start, w.End)
+		}
+		if w.Lit != nil && *w.Lit != *g.Lit {
+			t.Fatalf("got literal %q, want %q", *g.Lit, *w.Lit)
+		}
+		if w.Kind == EOF {
+			break
+		}
+	}
+	if want.Offset != len(src) {
+		t.Fatalf("scanner stopped at %d of %d", want.Offset, len(src))
+	}
+}
+
+func TestTokenPositions(t *testing.T) {
+	src := "let s = \"ü\";\nprint s, größe;"
+	sc := NewScanner(src)
+	for tok := sc.Next(); tok.Kind != EOF; tok = sc.Next() {
+		if tok.Kind == STR_LIT && src[tok.Start.Offset:tok.End.Offset] != `"ü"` {
+			t.Fatalf("string token spans %q", src[tok.Start.Offset:tok.End.Offset])
+		}
+		if tok.Kind == PRINT && tok.Start != (Position{Offset: 14, Line: 2, Column: 1}) {
+			t.Fatalf("print token at %+v", tok.Start)
+		}
+		if tok.Kind == IDENT && *tok.Lit == "größe" {
+			if tok.Start.Column != 10 || tok.End.Column != 15 {
+				t.Fatalf("identifier spans columns %v-%v", tok.Start.Column, tok.End.Column)
+			}
+			return
+		}
+	}
+	t.Fatal("unicode identifier not found")
+}
+
+func TestNumberLiterals(t *testing.T) {
+	tests := []struct {
+		src  string
+		kind TokenKind
+		lit  string
+	}{
+		{"1_000", INT_LIT, "1000"},
+		{"0x_ff", INT_LIT, "0xff"},
+		{"0XFF", INT_LIT, "0xFF"},
+		{"0o17", INT_LIT, "0o17"},
+		{"0b1010", INT_LIT, "0b1010"},
+		{"2.5", FLOAT_LIT, "2.5"},
+		{"1e9", FLOAT_LIT, "1e9"},
+		{"2.5E-3", FLOAT_LIT, "2.5e-3"},
+		{".5", FLOAT_LIT, "0.5"},
+		{"0x", ILLEGAL, "invalid number literal 0x"},
+		{"0b12", ILLEGAL, "invalid number literal 0b12"},
+		{"1e+", ILLEGAL, "invalid number literal 1e+"},
+		{"1__0", ILLEGAL, "invalid number literal 1__0"},
+		{"12ab", ILLEGAL, "invalid number literal 12ab"},
+	}
+	for _, tt := range tests {
+		tok := NewScanner(tt.src).Next()
+		if tok.Kind != tt.kind || *tok.Lit != tt.lit {
+			t.Errorf("%s: got %v %q, want %v %q", tt.src, tok.Kind, *tok.Lit, tt.kind, tt.lit)
+		}
+	}
+}
+
+func TestAutoSemi(t *testing.T) {
+	src := "//glox:autosemi\nlet x = f(1)\nx += 2 +\n  3\nif x {\n}\nreturn"
+	want := []TokenKind{
+		LET, IDENT, ASSIGN, IDENT, LPAREN, INT_LIT, RPAREN, SEMI,
+		IDENT, ADD_ASSIGN, INT_LIT, ADD, INT_LIT, SEMI,
+		IF, IDENT, LBRACE, RBRACE, SEMI,
+		RETURN, SEMI, EOF,
+	}
+	sc := NewScanner(src)
+	for i, kind := range want {
+		if tok := sc.Next(); tok.Kind != kind {
+			t.Fatalf("token %d: got %v, want %v", i, tok.Kind, kind)
+		}
+	}
+	sc = NewScanner("let x = 1\nx\n")
+	for tok := sc.Next(); tok.Kind != EOF; tok = sc.Next() {
+		if tok.Kind == SEMI {
+			t.Fatal("semicolon inserted without opting in")
+		}
+	}
+}
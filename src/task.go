@@ -0,0 +1,125 @@
+package glox
+
+import "fmt"
+
+// loop iterations a task runs before the other ready tasks get a turn
+const TIME_SLICE = 1000
+
+// a concurrently running call, the main script is a task too. Tasks run one
+// at a time on the VM's goroutine and switch at channel operations, at loop
+// back edges once their time slice is used up and when they finish, so
+// globals are shared between tasks without data races
+type task struct {
+	fiber
+	resumers []resumer
+
+	// set when a channel operation woke the task up
+	woken  bool
+	inbox  Value // received value
+	closed bool  // the receive found the channel closed
+	exit   int   // where a for loop continues when the channel is closed, -1 for recv
+	err    error // raised when the task runs again
+}
+
+type receiver struct {
+	t    *task
+	exit int // see task.exit
+}
+
+type sender struct {
+	t   *task
+	val Value
+	lin int
+}
+
+// hand the result of a receive to a blocked task and make it ready
+func (vm *VM) wake(t *task, val Value, closed bool, exit int) {
+	t.woken, t.inbox, t.closed, t.exit = true, val, closed, exit
+	vm.ready = append(vm.ready, t)
+}
+
+// give the VM to the next ready task, the current task must already be
+// waiting on a channel, queued in ready or finished
+func (vm *VM) schedule(lin int) error {
+	if len(vm.ready) == 0 {
+		return fmt.Errorf("all tasks are asleep - deadlock:%v", lin)
+	}
+	vm.current.fiber, vm.current.resumers = vm.fiber, vm.resumers
+	t := vm.ready[0]
+	vm.ready = vm.ready[1:]
+	vm.current = t
+	vm.fiber, vm.resumers = t.fiber, t.resumers
+	vm.ticks = 0
+	if t.woken {
+		t.woken = false
+		if t.closed && t.exit >= 0 {
+			vm.cur_frame().ip = t.exit
+		} else {
+			vm.push(t.inbox)
+		}
+	}
+	err := t.err
+	t.err = nil
+	return err
+}
+
+func (vm *VM) send(ch *ChannelObject, val Value, lin int) error {
+	if ch.closed {
+		return runtimeError(lin, "send on closed channel")
+	}
+	if len(ch.recvq) > 0 {
+		r := ch.recvq[0]
+		ch.recvq = ch.recvq[1:]
+		vm.wake(r.t, val, false, r.exit)
+		return nil
+	}
+	if len(ch.buf) < ch.cap {
+		ch.buf = append(ch.buf, val)
+		return nil
+	}
+	ch.sendq = append(ch.sendq, sender{t: vm.current, val: val, lin: lin})
+	return vm.schedule(lin)
+}
+
+// take a value from ch, ok is false once ch is closed and drained. When
+// nothing can be received the current task waits on ch and blocked is set
+func (vm *VM) recv(ch *ChannelObject, exit int) (val Value, ok bool, blocked bool) {
+	if len(ch.buf) > 0 {
+		val = ch.buf[0]
+		ch.buf = ch.buf[1:]
+		if len(ch.sendq) > 0 { // the oldest blocked send fills the freed slot
+			s := ch.sendq[0]
+			ch.sendq = ch.sendq[1:]
+			ch.buf = append(ch.buf, s.val)
+			vm.ready = append(vm.ready, s.t)
+		}
+		return val, true, false
+	}
+	if len(ch.sendq) > 0 {
+		s := ch.sendq[0]
+		ch.sendq = ch.sendq[1:]
+		vm.ready = append(vm.ready, s.t)
+		return s.val, true, false
+	}
+	if ch.closed {
+		return NilValue, false, false
+	}
+	ch.recvq = append(ch.recvq, receiver{t: vm.current, exit: exit})
+	return NilValue, false, true
+}
+
+func (vm *VM) close(ch *ChannelObject, lin int) error {
+	if ch.closed {
+		return runtimeError(lin, "close of closed channel")
+	}
+	ch.closed = true
+	for _, r := range ch.recvq {
+		vm.wake(r.t, NilValue, true, r.exit)
+	}
+	for _, s := range ch.sendq {
+		s.t.err = runtimeError(s.lin, "send on closed channel")
+		vm.ready = append(vm.ready, s.t)
+	}
+	ch.recvq, ch.sendq = nil, nil
+	return nil
+}
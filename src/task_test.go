@@ -0,0 +1,146 @@
+package glox
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const fanOut = `
+fn worker(jobs, results) {
+    for j in jobs { send results, j * j; }
+}
+let jobs = chan(4);
+let results = chan();
+let w = 0;
+while w < 3 { spawn worker(jobs, results); w += 1; }
+spawn fn () {
+    let i = 1;
+    while i <= 10 { send jobs, i; i += 1; }
+    close jobs;
+}();
+let sum = 0;
+let n = 0;
+while n < 10 { sum += recv results; n += 1; }
+if sum != 385 { throw sum; }
+
+// tasks share globals and are preempted in long loops
+let counter = 0;
+fn count(done) {
+    let k = 0;
+    while k < 5000 { counter += 1; k += 1; }
+    send done, nil;
+}
+let done = chan();
+spawn count(done);
+spawn count(done);
+recv done;
+recv done;
+if counter != 10000 { throw counter; }
+`
+
+func TestTasks(t *testing.T) {
+	if err := Interpret(fanOut); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		src string
+		err string
+	}{
+		{"let c = chan(); close c; close c;", "close of closed channel:1"},
+		{"let c = chan(); close c; send c, 1;", "send on closed channel:1"},
+		{"let c = chan(); spawn fn () { send c, 1; }(); spawn fn () { close c; }(); recv chan();", "send on closed channel:1"},
+		{"let c = chan(1); close c; recv c; recv chan();", "all tasks are asleep - deadlock:1"},
+		{"let c = chan(); spawn fn () { throw \"boom\"; }(); recv c;", "uncaught exception boom:1"},
+		{"fn f() {}\nspawn f;", "spawn expects a call:2:1"},
+		{"fn w(n) {}\nspawn true ? w(1) : w(2);", "spawn expects a call:2:1"},
+		{"fn f() {}\nlet a = false;\nspawn a || f();", "spawn expects a call:3:1"},
+		{"fn f() {}\nspawn (false || f());", "spawn expects a call:2:1"},
+	}
+	for _, tt := range tests {
+		err := Interpret(tt.src)
+		if err == nil || err.Error() != tt.err {
+			t.Errorf("%q: got %v, want %v", tt.src, err, tt.err)
+		}
+	}
+	var e *RuntimeError
+	err := Interpret("let c = chan(); close c; try { send c, 1; } catch e { throw e; }")
+	if !errors.As(err, &e) || !strings.HasPrefix(e.Msg, "send on closed") {
+		t.Errorf("catching a send on a closed channel: got %v", err)
+	}
+}
+
+// every VM runs on the goroutine that called Interpret, separate VMs share nothing
+func TestTasksParallelVMs(t *testing.T) {
+	var wg sync.WaitGroup
+	errs := make([]error, 4)
+	for i := range errs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = Interpret(fanOut)
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+// eprint, chan, send, recv and close are only builtins while the script has
+// no declaration of its own with that name, and send, recv and close aren't
+// when they are called
+func TestChannelNames(t *testing.T) {
+	tests := []struct {
+		src string
+		out string
+	}{
+		{"let chan = 5;\nlet send = chan * 2;\nprint chan, send;", "5 10\n"},
+		{"fn recv(n) { return n == 0 ? 0 : recv(n - 1) + 2; }\nprint recv(3);", "6\n"},
+		{"fn close(f) { f(); }\nclose(fn () { print \"closed\"; });", "closed\n"},
+		{
+			"fn f(send, close) { return send + close; }\nprint f(1, 2);\n" +
+				"let c = chan(1);\nsend c, 3;\nclose c;\nprint recv c, recv c;",
+			"3\n3 nil\n",
+		},
+		// followed by ( they are calls, the function can come later
+		{"fn use() { return recv(1); }\nfn recv(x) { return x; }\nprint use();", "1\n"},
+		{"fn f() { send(1); close(2); }\nfn send(x) { print x; }\nfn close(x) { print x; }\nf();", "1\n2\n"},
+		{"{\n    send(3);\n    fn send(x) { print x; }\n}", "3\n"},
+		// so is eprint, which keeps its call form like chan
+		{"let eprint = 1;\nprint eprint + 1;", "2\n"},
+		{"fn eprint(x) { print x; }\neprint(4);", "4\n"},
+	}
+	for _, tt := range tests {
+		var out strings.Builder
+		if err := InterpretWithOptions(tt.src, Options{Stdout: &out}); err != nil {
+			t.Errorf("%q: %v", tt.src, err)
+			continue
+		}
+		if out.String() != tt.out {
+			t.Errorf("%q: got %q, want %q", tt.src, out.String(), tt.out)
+		}
+	}
+
+	errs := []struct {
+		src string
+		err string
+	}{
+		{"fn f() { return chan(1); }\nfn chan(n) { return n; }", "chan is used as the builtin before its declaration:1:17"},
+		{"fn f(c) { return recv c; }\nlet recv = 1;", "recv is used as the builtin before its declaration:1:18"},
+		{"fn f(c) { close c; }\nimport \"lib.glox\" as close;", "close is used as the builtin before its declaration:1:11"},
+		{"let c = chan(1);\nsend(c, 1);", "undefined variable send:2:1"},
+		{"fn f() { eprint(5); }\nfn eprint(x) { print x; }", "eprint is used as the builtin before its declaration:1:10"},
+	}
+	loader := func(string) ([]byte, error) { return []byte("let x = 1;"), nil }
+	for _, tt := range errs {
+		err := InterpretWithOptions(tt.src, Options{Loader: loader})
+		if err == nil || err.Error() != tt.err {
+			t.Errorf("%q: got %v, want %v", tt.src, err, tt.err)
+		}
+	}
+}
@@ -45,6 +45,8 @@ const (
 	LOR    // ||
 	ASSIGN // =
 
+	QUESTION // ? of a conditional expression
+
 	// AssignOp // Op=
 	MUL_ASSIGN // *=
 	DIV_ASSIGN // /=
@@ -68,20 +70,40 @@ const (
 
 	SEMI  // ;
 	COMMA // ,
+	COLON // :
+	ARROW // =>
+	DOT   // .
+
+	RANGE    // ..
+	RANGE_EQ // ..=
 
 	// keywords
 	LET      // let
+	CONST    // const
 	FUNC     // fn
 	RETURN   // return
 	IF       // if
 	ELSE     // else
 	WHILE    // while
+	MATCH    // match
+	TRY      // try
+	CATCH    // catch
+	THROW    // throw
+	IMPORT   // import
+	YIELD    // yield
+	FOR      // for
+	SPAWN    // spawn
 	BREAK    // break
 	CONTINUE // continue
 	NIL      // nil
 
 	// builtin
-	PRINT // print
+	PRINT  // print
+	EPRINT // eprint
+	CHAN   // chan
+	SEND   // send
+	RECV   // recv
+	CLOSE  // close
 )
 
 func (tk TokenKind) String() string {
@@ -117,6 +139,8 @@ func (tk TokenKind) String() string {
 		"LOR",
 		"ASSIGN",
 
+		"QUESTION",
+
 		"MUL_ASSIGN",
 		"DIV_ASSIGN",
 		"MOD_ASSIGN",
@@ -139,19 +163,39 @@ func (tk TokenKind) String() string {
 
 		"SEMI",
 		"COMMA",
+		"COLON",
+		"ARROW",
+		"DOT",
+
+		"RANGE",
+		"RANGE_EQ",
 
 		"LET",
+		"CONST",
 		"FUNC",
 		"RETURN",
 		"IF",
 		"ELSE",
 		"WHILE",
+		"MATCH",
+		"TRY",
+		"CATCH",
+		"THROW",
+		"IMPORT",
+		"YIELD",
+		"FOR",
+		"SPAWN",
 
 		"BREAK",
 		"CONTINUE",
 		"NIL",
 
 		"PRINT",
+		"EPRINT",
+		"CHAN",
+		"SEND",
+		"RECV",
+		"CLOSE",
 	}
 	if int(tk) < len(strs) {
 		return strs[tk]
@@ -161,7 +205,7 @@ func (tk TokenKind) String() string {
 
 func (tk TokenKind) IsOp() bool {
 	switch tk {
-	case TILDE, NOT, MUL, DIV, MOD, ADD, SUB, LSH, RSH, LSS, LEQ, GTR, GEQ, EQL, NEQ, AND, XOR, OR, LAND, LOR:
+	case TILDE, NOT, MUL, DIV, MOD, ADD, SUB, LSH, RSH, LSS, LEQ, GTR, GEQ, EQL, NEQ, AND, XOR, OR, LAND, LOR, QUESTION:
 		return true
 	}
 	return false
@@ -169,7 +213,7 @@ func (tk TokenKind) IsOp() bool {
 
 func (tk TokenKind) IsBuiltin() bool {
 	switch tk {
-	case PRINT:
+	case PRINT, EPRINT, CHAN, SEND, RECV, CLOSE:
 		return true
 	}
 	return false
@@ -177,11 +221,20 @@ func (tk TokenKind) IsBuiltin() bool {
 
 var Keywords = map[string]TokenKind{
 	"let":      LET,
+	"const":    CONST,
 	"fn":       FUNC,
 	"return":   RETURN,
 	"if":       IF,
 	"else":     ELSE,
 	"while":    WHILE,
+	"match":    MATCH,
+	"try":      TRY,
+	"catch":    CATCH,
+	"throw":    THROW,
+	"import":   IMPORT,
+	"yield":    YIELD,
+	"for":      FOR,
+	"spawn":    SPAWN,
 	"break":    BREAK,
 	"continue": CONTINUE,
 	"nil":      NIL,
@@ -191,35 +244,59 @@ var Builtins = map[string]TokenKind{
 	"print": PRINT,
 }
 
+// scanned as identifiers, the parser takes them as builtins unless the script
+// declares a variable or function with that name
+var Contextual = map[string]TokenKind{
+	"eprint": EPRINT,
+	"chan":   CHAN,
+	"send":   SEND,
+	"recv":   RECV,
+	"close":  CLOSE,
+}
+
 const (
 	LOWEST_PREC  = 0 // non-operators
-	UNARY_PREC   = 7
-	HIGHEST_PREC = 8
+	UNARY_PREC   = 8
+	HIGHEST_PREC = 9
 )
 
 // precedence order copied from golang
 func (op TokenKind) Prec() int {
 	switch op {
-	case LOR:
+	case QUESTION: // not in go, binds looser than everything else
 		return 1
-	case LAND:
+	case LOR:
 		return 2
-	case EQL, NEQ, LSS, LEQ, GTR, GEQ:
+	case LAND:
 		return 3
-	case ADD, SUB, OR, XOR:
+	case EQL, NEQ, LSS, LEQ, GTR, GEQ:
 		return 4
-	case MUL, DIV, MOD, LSH, RSH, AND:
+	case ADD, SUB, OR, XOR:
 		return 5
-	case LPAREN:
+	case MUL, DIV, MOD, LSH, RSH, AND:
 		return 6
+	case LPAREN:
+		return 7
 	}
 	return LOWEST_PREC
 }
 
+type Position struct {
+	Offset int // in bytes
+	Line   int
+	Column int // in characters, 1 based
+}
+
+func (pos Position) String() string {
+	return fmt.Sprintf("%v:%v", pos.Line, pos.Column)
+}
+
 type Token struct {
-	Kind TokenKind
-	Lit  *string
-	Line int
+	Kind  TokenKind
+	Lit   *string
+	Line  int
+	Start Position // first character
+	End   Position // just past the last character
 }
 
 func (tk Token) String() string {
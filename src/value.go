@@ -1,43 +1,135 @@
 package glox
 
-import "fmt"
+import (
+	"fmt"
+	"math"
+	"strconv"
+)
 
-type Value interface {
-	isValue()
-}
+type ValueKind byte
+
+const (
+	NIL_VAL ValueKind = iota
+	BOOL_VAL
+	INT_VAL
+	FLOAT_VAL
+	OBJ_VAL
+)
 
-type BoolValue bool
-type IntValue int64
-type FloatValue float64
-type ObjectValue Object
+// Value is a tagged struct, numbers and bools live in bits so pushing them
+// on the stack never allocates, heap objects go through obj. On 64-bit
+// platforms it takes four words: kind padded to a word, bits, and the type
+// and data words of obj
+type Value struct {
+	kind ValueKind
+	bits uint64
+	obj  Object
+}
 
 type Object interface{ isObject() }
-type NilObject struct{}
 
 type StringObject struct{ inner *string }
 type FuntionObject struct {
-	name  *string
-	arity int
-	chunk *Chunk
+	name      *string
+	arity     int
+	chunk     *Chunk
+	generator bool // contains yield, calling it creates a coroutine
+}
+
+// ChannelObject passes values between tasks like a Go channel, a send
+// blocks until a receiver takes the value or there is room in the buffer
+type ChannelObject struct {
+	buf    []Value
+	cap    int
+	closed bool
+	recvq  []receiver // tasks blocked in a receive, oldest first
+	sendq  []sender   // tasks blocked in a send, oldest first
+}
+
+// CoroutineObject is a call of a generator function that runs on its own
+// stacks, suspended at a yield until it is resumed
+type CoroutineObject struct {
+	fiber
+	started bool
+	running bool // it or a coroutine it resumed is running
+	done    bool
 }
 
 type StructObject map[*string]Value
 
-func (v BoolValue) isValue()     {}
-func (v IntValue) isValue()      {}
-func (v FloatValue) isValue()    {}
-func (v NilObject) isValue()     {}
-func (v StringObject) isValue()  {}
-func (v FuntionObject) isValue() {}
-func (v StructObject) isValue()  {}
+// RangeObject is a range pattern of a match arm, lo and hi are numbers of the same type
+type RangeObject struct {
+	lo, hi    Value
+	inclusive bool
+}
+
+func (v StringObject) isObject()     {}
+func (v *FuntionObject) isObject()   {}
+func (v StructObject) isObject()     {}
+func (v *RangeObject) isObject()     {}
+func (v *CoroutineObject) isObject() {}
+func (v *ChannelObject) isObject()   {}
+
+var NilValue = Value{}
+
+func BoolVal(b bool) Value {
+	if b {
+		return Value{kind: BOOL_VAL, bits: 1}
+	}
+	return Value{kind: BOOL_VAL}
+}
+func IntVal(i int64) Value     { return Value{kind: INT_VAL, bits: uint64(i)} }
+func FloatVal(f float64) Value { return Value{kind: FLOAT_VAL, bits: math.Float64bits(f)} }
+func ObjVal(o Object) Value    { return Value{kind: OBJ_VAL, obj: o} }
+func StringVal(s *string) Value {
+	return ObjVal(StringObject{inner: s})
+}
+
+func (v Value) IsNil() bool      { return v.kind == NIL_VAL }
+func (v Value) IsBool() bool     { return v.kind == BOOL_VAL }
+func (v Value) IsInt() bool      { return v.kind == INT_VAL }
+func (v Value) IsFloat() bool    { return v.kind == FLOAT_VAL }
+func (v Value) AsBool() bool     { return v.bits != 0 }
+func (v Value) AsInt() int64     { return int64(v.bits) }
+func (v Value) AsFloat() float64 { return math.Float64frombits(v.bits) }
+func (v Value) AsObject() Object { return v.obj }
 
-func (v NilObject) isObject()     {}
-func (v StringObject) isObject()  {}
-func (v FuntionObject) isObject() {}
-func (v StructObject) isObject()  {}
+func (v Value) IsString() bool {
+	_, ok := v.obj.(StringObject)
+	return v.kind == OBJ_VAL && ok
+}
+
+func (v Value) AsString() StringObject { return v.obj.(StringObject) }
+
+func (v Value) AsFunction() (*FuntionObject, bool) {
+	f, ok := v.obj.(*FuntionObject)
+	return f, v.kind == OBJ_VAL && ok
+}
+
+func (v Value) String() string {
+	switch v.kind {
+	case NIL_VAL:
+		return "nil"
+	case BOOL_VAL:
+		return strconv.FormatBool(v.AsBool())
+	case INT_VAL:
+		return strconv.FormatInt(v.AsInt(), 10)
+	case FLOAT_VAL:
+		return fmt.Sprint(v.AsFloat())
+	}
+	return fmt.Sprint(v.obj)
+}
 
-func (v NilObject) String() string    { return "nil" }
 func (v StringObject) String() string { return *v.inner }
+func (v *FuntionObject) String() string {
+	if v.name == nil {
+		return "<script>"
+	}
+	if *v.name == "" {
+		return "<fn>"
+	}
+	return "<fn " + *v.name + ">"
+}
 func (v StructObject) String() string {
 	res := "struct{\n"
 	for key, val := range v {
@@ -47,4 +139,25 @@ func (v StructObject) String() string {
 	return res
 }
 
-// func (v FuntionObject) String() string { return "fn " + k + "(" + string(v.arity) + ")" }
+func (v *RangeObject) String() string {
+	if v.inclusive {
+		return fmt.Sprint(v.lo, "..=", v.hi)
+	}
+	return fmt.Sprint(v.lo, "..", v.hi)
+}
+
+func (v *CoroutineObject) String() string { return "<coroutine>" }
+func (v *ChannelObject) String() string   { return "<chan>" }
+
+// reports why co can't be resumed with args_count values
+func (co *CoroutineObject) resumable(args_count int) error {
+	switch {
+	case args_count > 1:
+		return fmt.Errorf("a coroutine is resumed with at most one value")
+	case co.done:
+		return fmt.Errorf("cannot resume dead coroutine")
+	case co.running:
+		return fmt.Errorf("cannot resume running coroutine")
+	}
+	return nil
+}
@@ -1,12 +1,19 @@
 package glox
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"os"
 )
 
 const UINT8_MAX = 255
 const UINT16_MAX = 255 * 255
 const CALLFRAME_MAX = 255 * 255
+const FRAMES_INIT = 64 // call frames allocated up front, doubles up to the call depth limit
+const STACK_MAX = UINT16_MAX
+const STACK_INIT = 1024     // value stack slots allocated up front, doubles up to STACK_MAX
+const CHECK_INTERVAL = 1024 // instructions between checks of the context
 
 type CallFrame struct {
 	function  *FuntionObject
@@ -14,61 +21,217 @@ type CallFrame struct {
 	start_ind int // first index in value stack that this function can use
 }
 
+// an exception handler installed by OP_TRY
+type handler struct {
+	frame int // frame_count when the try started
+	sp    int
+	ip    int // start of the catch block
+}
+
+// the call frames and value stack code runs on, the main script and every
+// coroutine have their own
+type fiber struct {
+	frames      []CallFrame
+	frame_count int
+	handlers    []handler
+	stack       []Value
+	sp          int // index of the next free slot in stack
+}
+
+// the fiber that resumed a coroutine, waiting for it to yield or finish
+type resumer struct {
+	fiber
+	co   *CoroutineObject
+	exit int // where a for loop continues once co finishes, -1 when co was called
+}
+
 type VM struct {
-	frames []*CallFrame
-	// chunk   *Chunk
-	// ip      int
-	stack   []Value
-	globals map[string]Value
-	isPanic bool
+	fiber
+	resumers     []resumer // innermost last, empty while a task runs its own code
+	current      *task     // the task running on fiber
+	main         *task
+	ready        []*task // tasks waiting for their turn, next first
+	ticks        int     // loop iterations since the current task got the VM
+	globals      []Value
+	defined      []bool // late bound globals are undefined until their declaration runs
+	global_names []string
+	isPanic      bool // a stack overflowed, reported before the next instruction
+
+	max_instructions int64 // zero for no limit
+	max_depth        int
+	max_stack        int
+	max_memory       int64
+	ctx              context.Context
+	executed         int64 // instructions run before the current slice
+	slice            int64 // instructions the current slice started with
+	steps            int64 // instructions left in the current slice
+	memory           int64 // bytes held by the script, see Stats
+	peak_memory      int64
+	next_gc          int64 // memory that starts the next collection
+
+	stdout io.Writer
+	stderr io.Writer
+	format func(Value) string
+	line   []byte // reused to build the printed lines
 }
 
 func NewVM() *VM {
-	return &VM{
-		frames:  make([]*CallFrame, 0),
-		stack:   make([]Value, 0, UINT8_MAX+1),
-		globals: map[string]Value{},
+	return NewVMWithOptions(Options{})
+}
+
+// NewVMWithOptions makes a VM that enforces the limits in opts and prints
+// where opts says, the compile options are ignored
+func NewVMWithOptions(opts Options) *VM {
+	vm := &VM{
+		fiber:            fiber{frames: make([]CallFrame, FRAMES_INIT)},
+		max_instructions: opts.MaxInstructions,
+		max_depth:        CALLFRAME_MAX,
+		max_stack:        STACK_MAX,
+		max_memory:       opts.MaxMemory,
+		ctx:              opts.Context,
+		stdout:           os.Stdout,
+		stderr:           os.Stderr,
+		format:           Value.String,
+	}
+	if opts.Stdout != nil {
+		vm.stdout = opts.Stdout
+	}
+	if opts.Stderr != nil {
+		vm.stderr = opts.Stderr
 	}
+	if opts.Format != nil {
+		vm.format = opts.Format
+	}
+	if opts.MaxCallDepth > 0 {
+		vm.max_depth = opts.MaxCallDepth
+	}
+	if opts.MaxStack > 0 {
+		vm.max_stack = opts.MaxStack
+	}
+	vm.stack = make([]Value, min(STACK_INIT, vm.max_stack))
+	return vm
 }
 
-func (vm *VM) call(function *FuntionObject, args_count int) {
-	if len(vm.frames) >= CALLFRAME_MAX {
-		vm.isPanic = true
-		return
+// size the global slots for a compiled script
+func (vm *VM) setGlobals(globals []Global) {
+	vm.globals = make([]Value, len(globals))
+	vm.defined = make([]bool, len(globals))
+	vm.global_names = make([]string, len(globals))
+	for i, g := range globals {
+		vm.global_names[i] = g.name
+		if g.preset {
+			vm.globals[i] = g.value
+			vm.defined[i] = true
+		}
+	}
+}
+
+func (vm *VM) call(function *FuntionObject, args_count int) error {
+	if vm.frame_count >= vm.max_depth {
+		return &CallDepthError{Limit: vm.max_depth, Line: vm.cur_line()}
+	}
+	if vm.frame_count == len(vm.frames) {
+		frames := make([]CallFrame, min(2*len(vm.frames), vm.max_depth))
+		vm.alloc(int64(len(frames)-len(vm.frames)) * FRAME_SIZE)
+		copy(frames, vm.frames)
+		vm.frames = frames
 	}
 	if function.arity != args_count {
-		vm.isPanic = true
-		return
+		return runtimeError(vm.cur_line(), "invalid function call")
 	}
-	frame := &CallFrame{
+	vm.frames[vm.frame_count] = CallFrame{
 		function:  function,
 		ip:        0,
-		start_ind: len(vm.stack) - args_count,
+		start_ind: vm.sp - args_count,
+	}
+	vm.frame_count++
+	return nil
+}
+
+// a fiber for a call that runs apart from its caller, the callee and its
+// arguments become the bottom of the fiber's stack
+func newFiber(args []Value) fiber {
+	f, _ := args[0].AsFunction()
+	fb := fiber{
+		frames: make([]CallFrame, 4),
+		stack:  make([]Value, max(2*len(args), 16)),
+		sp:     len(args),
+	}
+	copy(fb.stack, args)
+	fb.frames[0] = CallFrame{function: f, start_ind: 1}
+	fb.frame_count = 1
+	return fb
+}
+
+// switch to co, sent is the value of the yield it is suspended at
+func (vm *VM) resume(co *CoroutineObject, sent Value, exit int) {
+	vm.resumers = append(vm.resumers, resumer{fiber: vm.fiber, co: co, exit: exit})
+	vm.fiber = co.fiber
+	co.running = true
+	if co.started {
+		vm.push(sent)
 	}
-	vm.frames = append(vm.frames, frame)
+	co.started = true
+}
+
+// leave the running coroutine for the fiber that resumed it
+func (vm *VM) suspend() resumer {
+	r := vm.resumers[len(vm.resumers)-1]
+	vm.resumers = vm.resumers[:len(vm.resumers)-1]
+	r.co.fiber = vm.fiber
+	r.co.running = false
+	vm.fiber = r.fiber
+	return r
+}
+
+// the running coroutine returned or failed, its stacks aren't needed anymore
+func (vm *VM) finish() resumer {
+	r := vm.suspend()
+	r.co.done = true
+	vm.free(COROUTINE_SIZE + r.co.fiber.size())
+	r.co.fiber = fiber{}
+	return r
 }
 
 func (vm *VM) push(v Value) {
-	if len(vm.stack) >= UINT8_MAX*UINT8_MAX {
-		vm.isPanic = true
-		return
+	if vm.sp == len(vm.stack) {
+		size := min(2*len(vm.stack), vm.max_stack)
+		if len(vm.stack) >= vm.max_stack {
+			// the next check reports the overflow, the instructions before
+			// it still need a working stack
+			vm.isPanic = true
+			vm.stop()
+			size = len(vm.stack) + STACK_INIT
+		}
+		stack := make([]Value, size)
+		vm.alloc(int64(len(stack)-len(vm.stack)) * VALUE_SIZE)
+		copy(stack, vm.stack)
+		vm.stack = stack
 	}
-	vm.stack = append(vm.stack, v)
+	vm.stack[vm.sp] = v
+	vm.sp++
 }
 
 func (vm *VM) pop() Value {
-	n := len(vm.stack)
-	res := vm.stack[n-1]
-	vm.stack = vm.stack[0 : n-1]
-	return res
+	vm.sp--
+	return vm.stack[vm.sp]
 }
+
 func (vm *VM) peek(distance int) Value {
-	n := len(vm.stack)
-	return vm.stack[n-1-distance]
+	return vm.stack[vm.sp-1-distance]
 }
 
 func (vm *VM) cur_frame() *CallFrame {
-	return vm.frames[len(vm.frames)-1]
+	return &vm.frames[vm.frame_count-1]
+}
+
+// line of the instruction being run, looked up only for errors
+func (vm *VM) cur_line() int {
+	return vm.cur_frame().line()
+}
+
+func (f *CallFrame) line() int {
+	return f.function.chunk.lines[f.ip-1]
 }
 
 func (vm *VM) readByte() byte {
@@ -90,280 +253,583 @@ func (vm *VM) readConst() Value {
 	return frame.function.chunk.consts[vm.readByte()]
 }
 
-func (vm *VM) readString() StringObject {
-	return vm.readConst().(StringObject)
-}
-
-func (vm *VM) binary(b, a Value, op OpCode) error {
-	ok := false
-	switch a.(type) {
-	case IntValue:
-		_, ok = b.(IntValue)
-	case FloatValue:
-		_, ok = b.(FloatValue)
-	case BoolValue:
-		_, ok = b.(BoolValue)
-	case StringObject:
-		_, ok = b.(StringObject)
-	}
-	if !ok {
-		return fmt.Errorf("different type")
-	}
-	pnc := false
+// reports false for division by zero and negative shifts, binary turns those into errors
+func intBinary(a, b int64, op OpCode) (Value, bool) {
 	switch op {
 	case OP_ADD:
-		switch a.(type) {
-		case IntValue:
-			vm.push(a.(IntValue) + b.(IntValue))
-		case FloatValue:
-			vm.push(a.(FloatValue) + b.(FloatValue))
-		default:
-			pnc = true
-		}
+		return IntVal(a + b), true
 	case OP_SUB:
-		switch a.(type) {
-		case IntValue:
-			vm.push(a.(IntValue) - b.(IntValue))
-		case FloatValue:
-			vm.push(a.(FloatValue) - b.(FloatValue))
-		default:
-			pnc = true
-		}
+		return IntVal(a - b), true
 	case OP_MULT:
-		switch a.(type) {
-		case IntValue:
-			vm.push(a.(IntValue) * b.(IntValue))
-		case FloatValue:
-			vm.push(a.(FloatValue) * b.(FloatValue))
-		default:
-			pnc = true
-		}
+		return IntVal(a * b), true
 	case OP_DIV:
-		switch a.(type) {
-		case IntValue:
-			vm.push(a.(IntValue) / b.(IntValue))
-		case FloatValue:
-			vm.push(a.(FloatValue) / b.(FloatValue))
-		default:
-			pnc = true
+		if b == 0 {
+			return NilValue, false
 		}
+		return IntVal(a / b), true
 	case OP_MOD:
-		switch a.(type) {
-		case IntValue:
-			vm.push(a.(IntValue) % b.(IntValue))
-		default:
-			pnc = true
+		if b == 0 {
+			return NilValue, false
 		}
-	case OP_LOR:
-		switch a.(type) {
-		case BoolValue:
-			vm.push(a.(BoolValue) || b.(BoolValue))
-		default:
-			pnc = true
+		return IntVal(a % b), true
+	case OP_OR:
+		return IntVal(a | b), true
+	case OP_XOR:
+		return IntVal(a ^ b), true
+	case OP_LSH:
+		if b < 0 {
+			return NilValue, false
 		}
-	case OP_LAND:
-		switch a.(type) {
-		case BoolValue:
-			vm.push(a.(BoolValue) && b.(BoolValue))
-		default:
-			pnc = true
+		return IntVal(a << b), true
+	case OP_RSH:
+		if b < 0 {
+			return NilValue, false
 		}
+		return IntVal(a >> b), true
+	case OP_AND:
+		return IntVal(a & b), true
 	case OP_EQL:
-		switch a.(type) {
-		case IntValue:
-			vm.push(BoolValue(a.(IntValue) == b.(IntValue)))
-		case FloatValue:
-			vm.push(BoolValue(a.(FloatValue) == b.(FloatValue)))
-		case BoolValue:
-			vm.push(BoolValue(a.(BoolValue) == b.(BoolValue)))
-		default:
-			pnc = true
-		}
+		return BoolVal(a == b), true
+	case OP_NEQ:
+		return BoolVal(a != b), true
 	case OP_GTR:
-		switch a.(type) {
-		case IntValue:
-			vm.push(BoolValue(a.(IntValue) > b.(IntValue)))
-		case FloatValue:
-			vm.push(BoolValue(a.(FloatValue) > b.(FloatValue)))
-		default:
-			pnc = true
-		}
+		return BoolVal(a > b), true
+	case OP_GEQ:
+		return BoolVal(a >= b), true
 	case OP_LSS:
-		switch a.(type) {
-		case IntValue:
-			vm.push(BoolValue(a.(IntValue) < b.(IntValue)))
-		case FloatValue:
-			vm.push(BoolValue(a.(FloatValue) < b.(FloatValue)))
-		default:
-			pnc = true
+		return BoolVal(a < b), true
+	case OP_LEQ:
+		return BoolVal(a <= b), true
+	}
+	return NilValue, false
+}
+
+func floatBinary(a, b float64, op OpCode) (Value, bool) {
+	switch op {
+	case OP_ADD:
+		return FloatVal(a + b), true
+	case OP_SUB:
+		return FloatVal(a - b), true
+	case OP_MULT:
+		return FloatVal(a * b), true
+	case OP_DIV:
+		return FloatVal(a / b), true
+	case OP_EQL:
+		return BoolVal(a == b), true
+	case OP_NEQ:
+		return BoolVal(a != b), true
+	case OP_GTR:
+		return BoolVal(a > b), true
+	case OP_GEQ:
+		return BoolVal(a >= b), true
+	case OP_LSS:
+		return BoolVal(a < b), true
+	case OP_LEQ:
+		return BoolVal(a <= b), true
+	}
+	return NilValue, false
+}
+
+// a op b, both operands must have the same type
+func binary(a, b Value, op OpCode) (Value, error) {
+	if a.kind != b.kind {
+		return NilValue, fmt.Errorf("different type")
+	}
+	ok := false
+	res := NilValue
+	switch a.kind {
+	case INT_VAL:
+		switch {
+		case (op == OP_DIV || op == OP_MOD) && b.AsInt() == 0:
+			return NilValue, fmt.Errorf("integer divide by zero")
+		case (op == OP_LSH || op == OP_RSH) && b.AsInt() < 0:
+			return NilValue, fmt.Errorf("negative shift amount")
 		}
-	case OP_OR:
-		switch a.(type) {
-		case IntValue:
-			vm.push(a.(IntValue) | b.(IntValue))
-		default:
-			pnc = true
+		res, ok = intBinary(a.AsInt(), b.AsInt(), op)
+	case FLOAT_VAL:
+		res, ok = floatBinary(a.AsFloat(), b.AsFloat(), op)
+	case BOOL_VAL:
+		switch op {
+		case OP_EQL:
+			res, ok = BoolVal(a.AsBool() == b.AsBool()), true
+		case OP_NEQ:
+			res, ok = BoolVal(a.AsBool() != b.AsBool()), true
 		}
-	case OP_XOR:
-		switch a.(type) {
-		case IntValue:
-			vm.push(a.(IntValue) ^ b.(IntValue))
-		default:
-			pnc = true
+	case OBJ_VAL:
+		if !a.IsString() || !b.IsString() {
+			return NilValue, fmt.Errorf("different type")
 		}
-	case OP_LSH:
-		switch a.(type) {
-		case IntValue:
-			vm.push(a.(IntValue) << b.(IntValue))
-		default:
-			pnc = true
+	}
+	if !ok {
+		return NilValue, fmt.Errorf("unsupported type")
+	}
+	return res, nil
+}
+
+// pattern test of a match arm, values of different types never match
+func matches(v, pattern Value) bool {
+	if r, ok := pattern.obj.(*RangeObject); ok {
+		if v.kind != r.lo.kind {
+			return false
 		}
-	case OP_RSH:
-		switch a.(type) {
-		case IntValue:
-			vm.push(a.(IntValue) >> b.(IntValue))
-		default:
-			pnc = true
+		op := OP_LSS
+		if r.inclusive {
+			op = OP_LEQ
 		}
-	case OP_AND:
-		switch a.(type) {
-		case IntValue:
-			vm.push(a.(IntValue) & b.(IntValue))
+		above, _ := binary(r.lo, v, OP_LEQ)
+		below, _ := binary(v, r.hi, op)
+		return above.AsBool() && below.AsBool()
+	}
+	switch {
+	case v.kind != pattern.kind:
+		return false
+	case v.IsString() && pattern.IsString():
+		return *v.AsString().inner == *pattern.AsString().inner
+	case v.kind == OBJ_VAL:
+		return false // patterns are literals, only strings are objects
+	case v.kind == FLOAT_VAL:
+		return v.AsFloat() == pattern.AsFloat()
+	}
+	return v.bits == pattern.bits
+}
+
+func (vm *VM) run() error {
+	for {
+		err := vm.exec()
+		if err == nil || !vm.catch(err) {
+			return err
+		}
+	}
+}
+
+// unwind the frames and the stack to the innermost try and continue in its
+// catch block with the caught value on the stack, reports false when no
+// handler is left
+func (vm *VM) catch(err error) bool {
+	e, ok := err.(*RuntimeError)
+	if !ok {
+		return false
+	}
+	// an error nothing in a coroutine catches ends it and goes to its resumer
+	for len(vm.handlers) == 0 {
+		if len(vm.resumers) == 0 {
+			return false
+		}
+		vm.finish()
+	}
+	h := vm.handlers[len(vm.handlers)-1]
+	vm.handlers = vm.handlers[:len(vm.handlers)-1]
+	vm.frame_count = h.frame
+	vm.sp = h.sp
+	vm.push(e.Value)
+	vm.cur_frame().ip = h.ip
+	return true
+}
+
+// write the cnt values on top of the stack as one line, separated by spaces
+func (vm *VM) print(op OpCode, cnt int) error {
+	line := vm.line[:0]
+	for i := cnt - 1; i >= 0; i-- {
+		line = append(line, vm.format(vm.peek(i))...)
+		if i > 0 {
+			line = append(line, ' ')
+		}
+	}
+	line = append(line, '\n')
+	vm.line = line
+	vm.sp -= cnt
+	w := vm.stdout
+	if op == OP_EPRINT {
+		w = vm.stderr
+	}
+	_, err := w.Write(line)
+	return err
+}
+
+// start the next slice of instructions once the current one has run out,
+// or stop the script at a limit. Only back jumps, calls and returns check,
+// straight-line code between them is short and always ends
+func (vm *VM) checkLimits() error {
+	if vm.isPanic {
+		return &StackOverflowError{Limit: vm.max_stack, Line: vm.cur_line()}
+	}
+	if vm.max_memory > 0 && vm.memory > vm.max_memory {
+		return &MemoryLimitError{Limit: vm.max_memory, Line: vm.cur_line()}
+	}
+	vm.executed += vm.slice - vm.steps // steps is negative once a slice overran
+	if vm.ctx != nil {
+		select {
+		case <-vm.ctx.Done():
+			return &CanceledError{Err: vm.ctx.Err(), Line: vm.cur_line()}
 		default:
-			pnc = true
 		}
-	default:
-		pnc = true
 	}
-	if pnc {
-		return fmt.Errorf("unsupported type")
+	vm.slice = CHECK_INTERVAL
+	if vm.max_instructions > 0 {
+		left := vm.max_instructions - vm.executed
+		if left < 0 {
+			return &InstructionLimitError{Limit: vm.max_instructions, Line: vm.cur_line()}
+		}
+		vm.slice = min(vm.slice, left)
 	}
+	vm.steps = vm.slice
 	return nil
 }
 
-func (vm *VM) run() error {
+// end the current slice early, the next check stops the script
+func (vm *VM) stop() {
+	vm.slice -= vm.steps
+	vm.steps = 0
+}
+
+// run instructions until the script returns or raises an error
+func (vm *VM) exec() error {
 	for {
-		lin := vm.cur_frame().function.chunk.lines[vm.cur_frame().ip]
+		vm.steps--
 		instruciton := OpCode(vm.readByte())
 		switch instruciton {
 		case OP_CONST:
 			vm.push(vm.readConst())
+		case OP_CONST_LONG:
+			vm.push(vm.cur_frame().function.chunk.consts[vm.readUint16()])
 		case OP_POP:
 			vm.pop()
 
 		case OP_DEF_GLOBAL:
-			name := vm.readString().inner
-			vm.globals[*name] = vm.peek(0)
-			vm.pop()
+			ind := vm.readUint16()
+			vm.globals[ind] = vm.pop()
+			vm.defined[ind] = true
 		case OP_GET_GLOBAL:
-			name := vm.readString().inner
-			if val, ok := vm.globals[*name]; ok {
-				vm.push(val)
-			} else {
-				return fmt.Errorf("variable not found:%v", lin)
+			ind := vm.readUint16()
+			if !vm.defined[ind] {
+				return runtimeError(vm.cur_line(), "variable %v not found", vm.global_names[ind])
 			}
+			vm.push(vm.globals[ind])
 		case OP_SET_GLOBAL:
-			name := vm.readString().inner
-			if _, ok := vm.globals[*name]; ok {
-				vm.globals[*name] = vm.peek(0)
-				vm.pop()
-			} else {
-				return fmt.Errorf("variable not found:%v", lin)
+			ind := vm.readUint16()
+			if !vm.defined[ind] {
+				return runtimeError(vm.cur_line(), "variable %v not found", vm.global_names[ind])
 			}
+			vm.globals[ind] = vm.pop()
 		case OP_GET_LOCAL:
 			ind := vm.readByte()
 			vm.push(vm.stack[vm.cur_frame().start_ind+int(ind)])
 		case OP_SET_LOCAL:
 			ind := vm.readByte()
-			vm.stack[vm.cur_frame().start_ind+int(ind)] = vm.peek(0)
-			// vm.pop()
+			vm.stack[vm.cur_frame().start_ind+int(ind)] = vm.pop()
 		case OP_UNARY_ADD:
 		case OP_UNARY_SUB:
-			switch val := vm.pop(); val.(type) {
-			case IntValue:
-				vm.push(-val.(IntValue))
-			case FloatValue:
-				vm.push(-val.(FloatValue))
+			switch val := vm.pop(); val.kind {
+			case INT_VAL:
+				vm.push(IntVal(-val.AsInt()))
+			case FLOAT_VAL:
+				vm.push(FloatVal(-val.AsFloat()))
 			default:
-				return fmt.Errorf("invalid unary sub operation:%v", lin)
+				return runtimeError(vm.cur_line(), "invalid unary sub operation")
 			}
 		case OP_UNARY_NOT:
-			if val, ok := vm.pop().(BoolValue); ok {
-				vm.push(!val)
+			if val := vm.pop(); val.IsBool() {
+				vm.push(BoolVal(!val.AsBool()))
 			} else {
-				return fmt.Errorf("invalid unary not operation:%v", lin)
+				return runtimeError(vm.cur_line(), "invalid unary not operation")
 			}
 		case OP_UNARY_TILDE:
-			if val, ok := vm.pop().(IntValue); ok {
-				vm.push(^val)
+			if val := vm.pop(); val.IsInt() {
+				vm.push(IntVal(^val.AsInt()))
 			} else {
-				return fmt.Errorf("invalid tilde operation:%v", lin)
-			}
-		case OP_GTR, OP_LSS, OP_EQL, OP_LOR, OP_LAND, OP_ADD, OP_SUB, OP_OR, OP_XOR, OP_MULT, OP_DIV, OP_MOD, OP_LSH, OP_RSH, OP_AND:
-			if e := vm.binary(vm.pop(), vm.pop(), instruciton); e != nil {
-				return e
-			}
-		case OP_PRINT:
-			cnt := vm.readByte()
-			cnt2 := cnt
-			for cnt > 0 {
-				cnt -= 1
-				r := vm.peek(int(cnt))
-				fmt.Printf("%v ", r)
-			}
-			fmt.Println()
-			for cnt2 > 0 {
-				vm.pop()
-				cnt2 -= 1
+				return runtimeError(vm.cur_line(), "invalid tilde operation")
+			}
+		case OP_GTR, OP_GEQ, OP_LSS, OP_LEQ, OP_EQL, OP_NEQ, OP_ADD, OP_SUB, OP_OR, OP_XOR, OP_MULT, OP_DIV, OP_MOD, OP_LSH, OP_RSH, OP_AND:
+			n := vm.sp
+			a, b := vm.stack[n-2], vm.stack[n-1]
+			// fast paths, no type errors possible
+			if a.kind == INT_VAL && b.kind == INT_VAL {
+				if res, ok := intBinary(a.AsInt(), b.AsInt(), instruciton); ok {
+					vm.stack[n-2] = res
+					vm.sp--
+					break
+				}
+			} else if a.kind == FLOAT_VAL && b.kind == FLOAT_VAL {
+				if res, ok := floatBinary(a.AsFloat(), b.AsFloat(), instruciton); ok {
+					vm.stack[n-2] = res
+					vm.sp--
+					break
+				}
+			}
+			res, e := binary(a, b, instruciton)
+			if e != nil {
+				return runtimeError(vm.cur_line(), "%v", e)
+			}
+			vm.stack[n-2] = res
+			vm.sp--
+		case OP_PRINT, OP_EPRINT:
+			cnt := int(vm.readByte())
+			if err := vm.print(instruciton, cnt); err != nil {
+				return fmt.Errorf("%w:%v", err, vm.cur_line())
 			}
 		case OP_JUMP:
 			offset := vm.readUint16()
 			vm.cur_frame().ip += int(offset)
 		case OP_JUMP_IF_FALSE:
-			val, ok := vm.peek(0).(BoolValue)
-			if !ok {
-				return fmt.Errorf("invalid bool type operation:%v", lin)
+			val := vm.peek(0)
+			if !val.IsBool() {
+				return runtimeError(vm.cur_line(), "invalid bool type operation")
+			}
+			offset := vm.readUint16()
+			if !val.AsBool() {
+				vm.cur_frame().ip += int(offset)
+			}
+		case OP_JUMP_IF_TRUE:
+			val := vm.peek(0)
+			if !val.IsBool() {
+				return runtimeError(vm.cur_line(), "invalid bool type operation")
 			}
 			offset := vm.readUint16()
-			if val == false {
+			if val.AsBool() {
 				vm.cur_frame().ip += int(offset)
 			}
 		case OP_JUMP_BACK:
 			offset := vm.readUint16()
+			if vm.steps <= 0 {
+				if err := vm.checkLimits(); err != nil {
+					return err
+				}
+			}
 			vm.cur_frame().ip -= int(offset)
+			if len(vm.ready) > 0 {
+				vm.ticks++
+				if vm.ticks >= TIME_SLICE {
+					vm.ready = append(vm.ready, vm.current)
+					if err := vm.schedule(vm.cur_line()); err != nil {
+						return err
+					}
+				}
+			}
 		case OP_NIL:
-			vm.push(NilObject{})
+			vm.push(NilValue)
+		case OP_MATCH:
+			vm.push(BoolVal(matches(vm.peek(0), vm.readConst())))
+		case OP_TRY:
+			offset := vm.readUint16()
+			vm.handlers = append(vm.handlers, handler{frame: vm.frame_count, sp: vm.sp, ip: vm.cur_frame().ip + int(offset)})
+		case OP_END_TRY:
+			vm.handlers = vm.handlers[:len(vm.handlers)-1]
+		case OP_THROW:
+			val := vm.pop()
+			if e, ok := val.obj.(*RuntimeError); ok {
+				return e // rethrown, keeps where it was first raised
+			}
+			return &RuntimeError{Msg: "uncaught exception " + val.String(), Line: vm.cur_line(), Value: val}
 		case OP_CALL:
-			args_count := vm.readByte()
-			f, ok := vm.peek(int(args_count)).(*FuntionObject)
+			args_count := int(vm.readByte())
+			if vm.steps <= 0 {
+				if err := vm.checkLimits(); err != nil {
+					return err
+				}
+			}
+			callee := vm.peek(args_count)
+			if co, ok := callee.obj.(*CoroutineObject); ok { // co(value) resumes it
+				if err := co.resumable(args_count); err != nil {
+					return runtimeError(vm.cur_line(), "%v", err)
+				}
+				sent := NilValue
+				if args_count == 1 {
+					sent = vm.pop()
+				}
+				vm.pop()
+				vm.resume(co, sent, -1)
+				break
+			}
+			f, ok := callee.AsFunction()
 			if !ok {
-				return fmt.Errorf("expected function:%v", lin)
+				return runtimeError(vm.cur_line(), "expected function")
+			}
+			if f.generator {
+				if f.arity != args_count {
+					return runtimeError(vm.cur_line(), "invalid function call")
+				}
+				co := &CoroutineObject{fiber: newFiber(vm.stack[vm.sp-args_count-1 : vm.sp])}
+				vm.alloc(COROUTINE_SIZE + co.fiber.size())
+				vm.sp -= args_count
+				vm.stack[vm.sp-1] = ObjVal(co)
+				break
+			}
+			if err := vm.call(f, args_count); err != nil {
+				return err
 			}
-			vm.call(f, int(args_count))
 		case OP_RETURN:
+			if vm.steps <= 0 {
+				if err := vm.checkLimits(); err != nil {
+					return err
+				}
+			}
 			result := vm.pop()
-			vm.stack = vm.stack[0:vm.cur_frame().start_ind]
-			vm.frames = vm.frames[0 : len(vm.frames)-1]
-			if len(vm.frames) == 0 {
-				return nil
+			vm.sp = vm.cur_frame().start_ind
+			vm.frame_count--
+			// drop the handlers of a try the function returned from
+			for len(vm.handlers) > 0 && vm.handlers[len(vm.handlers)-1].frame > vm.frame_count {
+				vm.handlers = vm.handlers[:len(vm.handlers)-1]
+			}
+			if vm.frame_count == 0 {
+				if len(vm.resumers) == 0 {
+					if vm.current == vm.main {
+						return nil // like in Go, the other tasks end with the main script
+					}
+					vm.free(TASK_SIZE + vm.fiber.size())
+					if err := vm.schedule(vm.frames[0].line()); err != nil {
+						return err
+					}
+					break
+				}
+				if r := vm.finish(); r.exit >= 0 {
+					vm.cur_frame().ip = r.exit // for loop is done, the result is dropped
+				} else {
+					vm.push(result)
+				}
+				break
+			}
+			vm.stack[vm.sp-1] = result // replaces the callee
+		case OP_YIELD:
+			val := vm.pop()
+			vm.suspend()
+			vm.push(val)
+		case OP_FOR_ITER:
+			offset := int(vm.readUint16())
+			val := vm.pop()
+			if ch, ok := val.obj.(*ChannelObject); ok {
+				next, ok, blocked := vm.recv(ch, vm.cur_frame().ip+offset)
+				switch {
+				case blocked:
+					if err := vm.schedule(vm.cur_line()); err != nil {
+						return err
+					}
+				case !ok:
+					vm.cur_frame().ip += offset
+				default:
+					vm.push(next)
+				}
+				break
+			}
+			co, ok := val.obj.(*CoroutineObject)
+			if !ok {
+				return runtimeError(vm.cur_line(), "cannot iterate over %v", val)
+			}
+			if co.done {
+				vm.cur_frame().ip += offset
+				break
+			}
+			if err := co.resumable(0); err != nil {
+				return runtimeError(vm.cur_line(), "%v", err)
+			}
+			vm.resume(co, NilValue, vm.cur_frame().ip+offset)
+		case OP_SPAWN:
+			args_count := int(vm.readByte())
+			f, ok := vm.peek(args_count).AsFunction()
+			if !ok {
+				return runtimeError(vm.cur_line(), "expected function")
+			}
+			if f.generator || f.arity != args_count {
+				return runtimeError(vm.cur_line(), "invalid function call")
+			}
+			t := &task{fiber: newFiber(vm.stack[vm.sp-args_count-1 : vm.sp])}
+			vm.alloc(TASK_SIZE + t.fiber.size())
+			vm.ready = append(vm.ready, t)
+			vm.sp -= args_count + 1
+		case OP_CHAN:
+			size := vm.pop()
+			if !size.IsInt() || size.AsInt() < 0 || size.AsInt() > STACK_MAX {
+				return runtimeError(vm.cur_line(), "invalid channel capacity %v", size)
+			}
+			vm.alloc(CHANNEL_SIZE + size.AsInt()*VALUE_SIZE)
+			vm.push(ObjVal(&ChannelObject{cap: int(size.AsInt())}))
+		case OP_SEND:
+			val := vm.pop()
+			ch, ok := vm.pop().obj.(*ChannelObject)
+			if !ok {
+				return runtimeError(vm.cur_line(), "send to non-channel")
+			}
+			if err := vm.send(ch, val, vm.cur_line()); err != nil {
+				return err
+			}
+		case OP_RECV:
+			ch, ok := vm.pop().obj.(*ChannelObject)
+			if !ok {
+				return runtimeError(vm.cur_line(), "receive from non-channel")
+			}
+			val, _, blocked := vm.recv(ch, -1)
+			if !blocked {
+				vm.push(val)
+			} else if err := vm.schedule(vm.cur_line()); err != nil {
+				return err
+			}
+		case OP_CLOSE:
+			ch, ok := vm.pop().obj.(*ChannelObject)
+			if !ok {
+				return runtimeError(vm.cur_line(), "close of non-channel")
+			}
+			if err := vm.close(ch, vm.cur_line()); err != nil {
+				return err
 			}
-			vm.pop()
-			vm.push(result)
 		}
 	}
 }
 
+// Options configures compilation and execution of a script
+type Options struct {
+	NoOptimize bool             // skip the bytecode optimizer, useful when debugging the compiler
+	AutoSemi   bool             // end statements at line breaks like Go, a file can also opt in with //glox:autosemi
+	Warn       func(Diagnostic) // called with each compile warning, warnings are dropped when nil
+	Consts     map[string]Value // read-only globals the script can use but not assign or redeclare
+
+	// Path of the script, imports are resolved relative to it
+	Path string
+	// Loader reads an imported module given its slash separated path, os.ReadFile when nil
+	Loader func(path string) ([]byte, error)
+
+	// limits for running untrusted scripts, each stops the script with its
+	// own error type, zero means no limit or the default. The VM checks them
+	// at back jumps, calls and returns, so the straight-line code before a
+	// check can run past a limit
+	MaxInstructions int64           // instructions a run may execute
+	MaxCallDepth    int             // calls nested in a task or coroutine, CALLFRAME_MAX by default
+	MaxStack        int             // value stack slots of a task or coroutine, STACK_MAX by default
+	MaxMemory       int64           // bytes the script may hold at once, garbage is collected first, see Stats
+	Context         context.Context // checked after every CHECK_INTERVAL instructions, the script stops once it is done
+
+	Stdout io.Writer          // where print writes, os.Stdout when nil
+	Stderr io.Writer          // where eprint writes, os.Stderr when nil
+	Format func(Value) string // formats each printed value, Value.String when nil
+}
+
 func Interpret(input string) error {
-	p := NewParser(input)
-	p.compile()
-	if p.isPanic == true {
-		return fmt.Errorf("error")
+	return InterpretWithOptions(input, Options{})
+}
+
+func InterpretWithOptions(input string, opts Options) error {
+	return interpret(NewParser(input), opts)
+}
+
+// InterpretReader runs a script read from r without loading it all at once
+func InterpretReader(r io.Reader, opts Options) error {
+	return interpret(NewReaderParser(r), opts)
+}
+
+// apply the compile options to a new parser
+func (p *Parser) configure(opts Options) {
+	p.optimize = !opts.NoOptimize
+	p.AutoSemi = p.AutoSemi || opts.AutoSemi
+	p.autoSemi = opts.AutoSemi
+	p.path = opts.Path
+	if opts.Loader != nil {
+		p.loader = opts.Loader
 	}
-	vm := NewVM()
-	vm.call(p.function, 0)
-	err := vm.run()
-	if vm.isPanic && err == nil {
-		err = fmt.Errorf("error")
+	p.predeclare(opts.Consts)
+}
+
+func interpret(p *Parser, opts Options) error {
+	prog, err := compile(p, opts)
+	if err != nil {
+		return err
 	}
-	return err
+	return NewVMWithOptions(opts).Run(prog)
 }
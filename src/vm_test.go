@@ -0,0 +1,377 @@
+package glox
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+const sumLoop = `
+let i = 0;
+let sm = 0;
+while i < 1_000_000 {
+    i += 1;
+    sm += i;
+}
+`
+
+const sumLoopLocal = `
+fn sum(n) {
+    let i = 0;
+    let sm = 0;
+    while i < n {
+        i += 1;
+        sm += i;
+    }
+    return sm;
+}
+sum(1_000_000);
+`
+
+const floatLoop = `
+fn sum(n) {
+    let i = 0.0;
+    let sm = 0.0;
+    while i < n {
+        i += 1.0;
+        sm += i * 0.5;
+    }
+    return sm;
+}
+sum(1_000_000.0);
+`
+
+const fact = `
+fn fact(n) {
+    if n <= 1 {
+        return 1;
+    }
+    return n * fact(n-1);
+}
+let i = 0;
+while i < 10_000 {
+    fact(20);
+    i += 1;
+}
+`
+
+func benchmarkScript(b *testing.B, src string) {
+	b.ReportAllocs()
+	for range b.N {
+		if err := Interpret(src); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSumLoop(b *testing.B)      { benchmarkScript(b, sumLoop) }
+func BenchmarkSumLoopLocal(b *testing.B) { benchmarkScript(b, sumLoopLocal) }
+func BenchmarkFloatLoop(b *testing.B)    { benchmarkScript(b, floatLoop) }
+func BenchmarkFact(b *testing.B)         { benchmarkScript(b, fact) }
+
+// calling nil fails, so a script reaching nil() shows the operand ran
+func TestShortCircuit(t *testing.T) {
+	tests := []struct {
+		src string
+		ok  bool
+	}{
+		{"let a = false && nil();\nif a { nil(); }", true},
+		{"let a = true || nil();\nif !a { nil(); }", true},
+		{"let a = true && nil();", false},
+		{"let a = false || nil();", false},
+		{"if !(true && false || true) { nil(); }", true},
+		{"if false || false && nil() { nil(); }", true},
+		{"let a = 1 && true;", false},
+	}
+	for _, tt := range tests {
+		if err := Interpret(tt.src); (err == nil) != tt.ok {
+			t.Errorf("%q: got %v", tt.src, err)
+		}
+	}
+}
+
+// a local assignment must not leave its value on the stack, 200000 of
+// them would overflow it
+func TestLocalAssignment(t *testing.T) {
+	src := `
+fn sum(n) {
+    let i = 0;
+    let s = 0;
+    while i < n {
+        s += i;
+        i = i + 1;
+    }
+    return s;
+}
+if sum(100000) != 4999950000 { nil(); }
+`
+	if err := Interpret(src); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// recursion well past the frames allocated up front
+func TestDeepRecursion(t *testing.T) {
+	src := `
+fn f(n) {
+    if n == 0 {
+        return 0;
+    }
+    return 1 + f(n - 1);
+}
+if f(5000) != 5000 { nil(); }
+`
+	if err := Interpret(src); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGlobals(t *testing.T) {
+	tests := []struct {
+		src string
+		err string // empty when the script succeeds
+	}{
+		{"fn f() { return g(); }\nfn g() { return 1; }\nif f() != 1 { nil(); }", ""},
+		{"let a = 1;\nfn set() { a = 2; }\nset();\nif a != 2 { nil(); }", ""},
+		{"print y;", "undefined variable y:1:7"},
+		{"fn f() {\n    y = 1;\n}", "undefined variable y:2:5"},
+		{"fn f() { return b; }\nf();\nlet b = 1;", "variable b not found:1"},
+	}
+	for _, tt := range tests {
+		err := Interpret(tt.src)
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("%q: %v", tt.src, err)
+		case tt.err != "" && (err == nil || err.Error() != tt.err):
+			t.Errorf("%q: got %v, want %v", tt.src, err, tt.err)
+		}
+	}
+}
+
+func TestFunctionExpressions(t *testing.T) {
+	tests := []struct {
+		src string
+		err string // empty when the script succeeds
+	}{
+		{"let double = fn (x) { return x * 2; };\nif double(4) != 8 { nil(); }", ""},
+		{"fn apply(f, x) { return f(x); }\nif apply(fn (n) { return n + 1; }, 1) != 2 { nil(); }", ""},
+		{"fn adder() { return fn (a, b) { return a + b; }; }\nif adder()(1, 2) != 3 { nil(); }", ""},
+		// there are no closures, a function can't read the locals around it
+		{"fn outer() {\n    let x = 1;\n    return fn () { return x; };\n}", "can't capture local variable x of an enclosing scope:3:27"},
+		{"{\n    let x = 1;\n    fn g() { return x; }\n}", "can't capture local variable x of an enclosing scope:3:21"},
+	}
+	for _, tt := range tests {
+		err := Interpret(tt.src)
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("%q: %v", tt.src, err)
+		case tt.err != "" && (err == nil || err.Error() != tt.err):
+			t.Errorf("%q: got %v, want %v", tt.src, err, tt.err)
+		}
+	}
+}
+
+func TestLocalFunctions(t *testing.T) {
+	tests := []struct {
+		src string
+		err string // empty when the script succeeds
+	}{
+		{"fn outer() {\n    fn fact(n) { if n <= 1 { return 1; } return n * fact(n - 1); }\n    return fact(5);\n}\nif outer() != 120 { nil(); }", ""},
+		{"{\n    fn even(n) { if n == 0 { return true; } return odd(n - 1); }\n    fn odd(n) { if n == 0 { return false; } return even(n - 1); }\n    if even(10) == false { nil(); }\n}", ""},
+		{"fn f() {\n    let a = later();\n    fn later() { return 1; }\n    return a;\n}\nif f() != 1 { nil(); }", ""},
+		{"fn f() {\n    fn one() { return 1; }\n    let g = fn () { return one() + 1; };\n    return g();\n}\nif f() != 2 { nil(); }", ""},
+		{"fn f() {\n    fn g() {}\n    g = 1;\n}", "cannot assign to function g:3:5"},
+	}
+	for _, tt := range tests {
+		err := Interpret(tt.src)
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("%q: %v", tt.src, err)
+		case tt.err != "" && (err == nil || err.Error() != tt.err):
+			t.Errorf("%q: got %v, want %v", tt.src, err, tt.err)
+		}
+	}
+}
+
+// only the chosen branch runs, nil() fails if the other one does
+func TestConditional(t *testing.T) {
+	for _, src := range []string{
+		"let a = true ? 1 : nil();\nif a != 1 { nil(); }",
+		"let a = false ? nil() : 2;\nif a != 2 { nil(); }",
+		"if (false ? 1 : true ? 2 : 3) != 2 { nil(); }",
+		"let a = 1 < 2 || false ? 1 : 2;\nif a != 1 { nil(); }",
+	} {
+		if err := Interpret(src); err != nil {
+			t.Errorf("%q: %v", src, err)
+		}
+	}
+}
+
+func TestRuntimeErrors(t *testing.T) {
+	tests := []struct {
+		src  string
+		msg  string // of the uncaught error, empty when the script succeeds
+		line int
+	}{
+		{"let a = 1;\nlet b = a / 0;", "integer divide by zero", 2},
+		{"try { let b = 1 % 0; } catch e { throw e; }", "integer divide by zero", 1},
+		{"try { throw 1; } catch e { if e != 1 { throw \"wrong\"; } }", "", 0},
+		{"fn f() { throw \"bad\"; }\nfn g() { try { f(); } catch { return 1; } }\nif g() != 1 { throw 0; }", "", 0},
+		{"fn f() { try { return 1; } catch { } }\nf();\nthrow 2;", "uncaught exception 2", 3},
+		{"let i = 0; while i < 3 { try { i += 1; break; } catch { } } throw i;", "uncaught exception 1", 1},
+	}
+	for _, tt := range tests {
+		err := Interpret(tt.src)
+		if tt.msg == "" {
+			if err != nil {
+				t.Errorf("%q: %v", tt.src, err)
+			}
+			continue
+		}
+		var e *RuntimeError
+		if !errors.As(err, &e) {
+			t.Errorf("%q: got %v, want a RuntimeError", tt.src, err)
+			continue
+		}
+		if e.Msg != tt.msg || e.Line != tt.line {
+			t.Errorf("%q: got %q at line %v, want %q at line %v", tt.src, e.Msg, e.Line, tt.msg, tt.line)
+		}
+	}
+}
+
+func TestBreak(t *testing.T) {
+	for _, src := range []string{
+		// the block locals are popped, so after gets its own slot
+		"fn f() {\n    let total = 0;\n    while true {\n        let a = 1;\n        let b = 2;\n        total = a + b;\n        break;\n    }\n    let after = 100;\n    return after + total;\n}\nif f() != 103 { throw f(); }",
+		// the inner break doesn't end the outer loop
+		"let n = 0;\nwhile n < 10 {\n    if n == 3 { break; }\n    while true { break; }\n    n += 1;\n}\nif n != 3 { throw n; }",
+	} {
+		if err := Interpret(src); err != nil {
+			t.Errorf("%q: %v", src, err)
+		}
+	}
+}
+
+func TestCoroutines(t *testing.T) {
+	src := `
+fn count(n) {
+    let i = 0;
+    while i < n { yield i; i += 1; }
+}
+let sum = 0;
+for i in count(5) { sum += i; }
+if sum != 10 { throw sum; }
+
+fn acc() {
+    let total = 0;
+    while true { total += yield total; }
+}
+let a = acc();
+a();
+a(3);
+if a(4) != 7 { throw "send"; }
+
+fn nested() { for i in count(3) { yield i * 2; } }
+let last = 0;
+for v in nested() { if v == 4 { break; } last = v; }
+if last != 2 { throw last; }
+`
+	if err := Interpret(src); err != nil {
+		t.Fatal(err)
+	}
+	var e *RuntimeError
+	err := Interpret("fn g() { yield 1; }\nlet c = g();\nc(); c(); c();")
+	if !errors.As(err, &e) || e.Msg != "cannot resume dead coroutine" {
+		t.Errorf("resuming a finished coroutine: got %v", err)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	const recurse = "fn f(n) { let a = n; let b = n; return f(n + 1); }\n"
+	var steps *InstructionLimitError
+	err := InterpretWithOptions("while true {}", Options{MaxInstructions: 10_000})
+	if !errors.As(err, &steps) || steps.Limit != 10_000 {
+		t.Errorf("instruction limit: got %v", err)
+	}
+	if err := InterpretWithOptions(sumLoop, Options{MaxInstructions: 100_000_000}); err != nil {
+		t.Errorf("under the instruction limit: %v", err)
+	}
+
+	var depth *CallDepthError
+	err = InterpretWithOptions(recurse+"try { f(0); } catch e { }", Options{MaxCallDepth: 50})
+	if !errors.As(err, &depth) || depth.Limit != 50 || depth.Line != 1 {
+		t.Errorf("call depth limit: got %v", err)
+	}
+	err = InterpretWithOptions("fn g() { return g(); }\ng();", Options{MaxStack: 1 << 20})
+	if !errors.As(err, &depth) || depth.Limit != CALLFRAME_MAX {
+		t.Errorf("default call depth limit: got %v", err)
+	}
+
+	var stack *StackOverflowError
+	err = InterpretWithOptions(recurse+"f(0);", Options{MaxStack: 100})
+	if !errors.As(err, &stack) || stack.Limit != 100 {
+		t.Errorf("stack limit: got %v", err)
+	}
+	err = InterpretWithOptions(recurse+"fn g() { f(0); yield 1; }\ng()();", Options{MaxStack: 100})
+	if !errors.As(err, &stack) {
+		t.Errorf("stack limit in a coroutine: got %v", err)
+	}
+	// no call or loop until the end, the stack keeps growing up to the check
+	long := "let z = 0;\nprint z" + strings.Repeat(", z", 299) + ";"
+	err = InterpretWithOptions(long, Options{MaxStack: 100, Stdout: io.Discard})
+	if !errors.As(err, &stack) || stack.Line != 2 {
+		t.Errorf("stack limit in straight-line code: got %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	var canceled *CanceledError
+	err = InterpretWithOptions("while true {}", Options{Context: ctx})
+	if !errors.As(err, &canceled) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("context: got %v", err)
+	}
+	err = InterpretWithOptions("let c = chan(); spawn fn () { while true {} }(); recv c;", Options{Context: ctx})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("context with tasks: got %v", err)
+	}
+}
+
+type failWriter struct{}
+
+func (failWriter) Write([]byte) (int, error) { return 0, errors.ErrUnsupported }
+
+func TestPrint(t *testing.T) {
+	var out, errOut strings.Builder
+	src := "print 1, 2.5, true, nil;\nprint;\neprint \"oops\", 2;\neprint(3);\nprint -3;"
+	if err := InterpretWithOptions(src, Options{Stdout: &out, Stderr: &errOut}); err != nil {
+		t.Fatal(err)
+	}
+	if want := "1 2.5 true nil\n\n-3\n"; out.String() != want {
+		t.Errorf("stdout: got %q, want %q", out.String(), want)
+	}
+	if want := "oops 2\n3\n"; errOut.String() != want {
+		t.Errorf("stderr: got %q, want %q", errOut.String(), want)
+	}
+
+	out.Reset()
+	format := func(v Value) string {
+		if v.IsInt() {
+			return "#" + v.String()
+		}
+		return v.String()
+	}
+	if err := InterpretWithOptions("print 1, 2.0;", Options{Stdout: &out, Format: format}); err != nil {
+		t.Fatal(err)
+	}
+	if want := "#1 2\n"; out.String() != want {
+		t.Errorf("formatter: got %q, want %q", out.String(), want)
+	}
+
+	err := InterpretWithOptions("try { print 1; } catch e { }", Options{Stdout: failWriter{}})
+	if !errors.Is(err, errors.ErrUnsupported) || !strings.HasSuffix(err.Error(), ":1") {
+		t.Errorf("failing writer: got %v", err)
+	}
+}